@@ -1,24 +1,244 @@
 package main
 
 import (
-	"log"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
 	"strconv"
+	"text/tabwriter"
+
+	"github.com/ilhom0258/wallet/pkg/types"
+	"github.com/ilhom0258/wallet/pkg/wallet"
 )
 
+const usage = `usage: wallet [-data dir] [-format dump|json|csv] [-json] command [arguments]
+
+commands:
+  register <phone>                           register account
+  deposit <account-id> <amount>              deposit money to account
+  pay <account-id> <amount> <category>       make payment
+  reject <payment-id>                        reject payment and refund money
+  history <account-id>                       list payments of account
+  favorites <account-id>                     list favorites of account
+  export <dir>                               export data to dir in -format
+  import <dir>                               import data from dir in -format
+  validate <dir>                             check dump files in dir before import
+  sum                                        sum of all payments
+
+amounts are in minimal units (cents, dirams)
+`
+
+var errUsage = errors.New("invalid arguments")
+
 func main() {
+	if err := run(os.Args[1:], os.Stdout); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		if err == errUsage {
+			fmt.Fprint(os.Stderr, usage)
+			os.Exit(2)
+		}
+		os.Exit(1)
+	}
+}
+
+// client runs commands on service loaded from the data directory
+type client struct {
+	svc    *wallet.Service
+	format wallet.Format
+}
+
+// command returns result to print, changes reports that service has to be
+// exported back to the data directory
+type command struct {
+	args    int
+	changes bool
+	run     func(c *client, args []string) (interface{}, error)
+}
+
+var commands = map[string]command{
+	"register":  {1, true, (*client).register},
+	"deposit":   {2, true, (*client).deposit},
+	"pay":       {3, true, (*client).pay},
+	"reject":    {1, true, (*client).reject},
+	"history":   {1, false, (*client).history},
+	"favorites": {1, false, (*client).favorites},
+	"export":    {1, false, (*client).exportTo},
+	"import":    {1, true, (*client).importFrom},
+	"validate":  {1, false, (*client).validate},
+	"sum":       {0, false, (*client).sum},
+}
+
+func run(args []string, out io.Writer) error {
+	flags := flag.NewFlagSet("wallet", flag.ContinueOnError)
+	flags.SetOutput(ioutil.Discard)
+	dataDir := flags.String("data", "data", "directory with service data")
+	format := flags.String("format", string(wallet.FormatDump), "format of export and import files")
+	asJSON := flags.Bool("json", false, "print results as JSON")
+	if err := flags.Parse(args); err != nil {
+		return errUsage
+	}
+	if flags.NArg() == 0 {
+		return errUsage
+	}
+	cmd, ok := commands[flags.Arg(0)]
+	if !ok || flags.NArg()-1 != cmd.args {
+		return errUsage
+	}
+
+	c := &client{svc: &wallet.Service{}, format: wallet.Format(*format)}
+	if _, err := os.Stat(*dataDir); err == nil {
+		if err := c.svc.Import(*dataDir); err != nil {
+			return err
+		}
+	}
+	result, err := cmd.run(c, flags.Args()[1:])
+	if err != nil {
+		return err
+	}
+	if cmd.changes {
+		if err := c.svc.Export(*dataDir); err != nil {
+			return err
+		}
+	}
+	if result == nil {
+		return nil
+	}
+	if *asJSON {
+		encoder := json.NewEncoder(out)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(result)
+	}
+	return printText(out, result)
+}
+
+func (c *client) register(args []string) (interface{}, error) {
+	return c.svc.RegisterAccount(types.Phone(args[0]))
+}
+
+func (c *client) deposit(args []string) (interface{}, error) {
+	id, err := parseID(args[0])
+	if err != nil {
+		return nil, err
+	}
+	amount, err := parseAmount(args[1])
+	if err != nil {
+		return nil, err
+	}
+	if err := c.svc.Deposit(id, amount); err != nil {
+		return nil, err
+	}
+	return c.svc.FindAccountByID(id)
+}
 
-	ch := tick()
-	for i := range ch {
-		log.Print(i)
+func (c *client) pay(args []string) (interface{}, error) {
+	id, err := parseID(args[0])
+	if err != nil {
+		return nil, err
+	}
+	amount, err := parseAmount(args[1])
+	if err != nil {
+		return nil, err
 	}
+	return c.svc.Pay(id, amount, types.PaymentCategory(args[2]))
 }
-func tick() <-chan string {
-	ch := make(chan string)
-	go func() {
-		for i := 0; i < 10; i++ {
-			ch <- strconv.FormatInt(int64(i), 10)
+
+func (c *client) reject(args []string) (interface{}, error) {
+	return nil, c.svc.Reject(args[0])
+}
+
+func (c *client) history(args []string) (interface{}, error) {
+	id, err := parseID(args[0])
+	if err != nil {
+		return nil, err
+	}
+	payments, err := c.svc.ExportAccountHistory(id)
+	if payments == nil && err == nil {
+		payments = []types.Payment{}
+	}
+	return payments, err
+}
+
+func (c *client) favorites(args []string) (interface{}, error) {
+	id, err := parseID(args[0])
+	if err != nil {
+		return nil, err
+	}
+	return c.svc.AccountFavorites(id)
+}
+
+func (c *client) exportTo(args []string) (interface{}, error) {
+	return nil, c.svc.ExportAs(args[0], c.format)
+}
+
+func (c *client) importFrom(args []string) (interface{}, error) {
+	return nil, c.svc.ImportAs(args[0], c.format)
+}
+
+func (c *client) validate(args []string) (interface{}, error) {
+	issues, err := c.svc.ValidateImport(args[0])
+	if issues == nil && err == nil {
+		issues = []wallet.ImportIssue{}
+	}
+	return issues, err
+}
+
+func (c *client) sum(args []string) (interface{}, error) {
+	return c.svc.SumPayments(1), nil
+}
+
+func parseID(value string) (int64, error) {
+	id, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid account id %q", value)
+	}
+	return id, nil
+}
+
+func parseAmount(value string) (types.Money, error) {
+	amount, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid amount %q", value)
+	}
+	return types.Money(amount), nil
+}
+
+func printText(out io.Writer, result interface{}) error {
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	switch result := result.(type) {
+	case *types.Account:
+		fmt.Fprintf(w, "ID\tPHONE\tBALANCE\n")
+		fmt.Fprintf(w, "%v\t%v\t%v\n", result.ID, result.Phone, result.Balance)
+	case *types.Payment:
+		printPayments(w, []types.Payment{*result})
+	case []types.Payment:
+		printPayments(w, result)
+	case []types.Favorite:
+		fmt.Fprintf(w, "ID\tNAME\tAMOUNT\tCATEGORY\n")
+		for _, favorite := range result {
+			fmt.Fprintf(w, "%v\t%v\t%v\t%v\n", favorite.ID, favorite.Name, favorite.Amount, favorite.Category)
+		}
+	case []wallet.ImportIssue:
+		for _, issue := range result {
+			fmt.Fprintln(w, issue)
+		}
+	default:
+		fmt.Fprintln(w, result)
+	}
+	return w.Flush()
+}
+
+func printPayments(w io.Writer, payments []types.Payment) {
+	fmt.Fprintf(w, "ID\tACCOUNT\tAMOUNT\tCATEGORY\tSTATUS\tCREATED\n")
+	for _, payment := range payments {
+		created := ""
+		if !payment.Created.IsZero() {
+			created = payment.Created.Format("2006-01-02 15:04:05")
 		}
-		close(ch)
-	}()
-	return ch
+		fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\t%v\n",
+			payment.ID, payment.AccountID, payment.Amount, payment.Category, payment.Status, created)
+	}
 }
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/ilhom0258/wallet/pkg/types"
+)
+
+func TestRun(t *testing.T) {
+	dir := t.TempDir()
+	exec := func(args ...string) string {
+		t.Helper()
+		out := &bytes.Buffer{}
+		if err := run(append([]string{"-data", dir}, args...), out); err != nil {
+			t.Fatalf("%v: %v", args, err)
+		}
+		return out.String()
+	}
+
+	exec("register", "+992000000001")
+	exec("deposit", "1", "1000")
+	var payment types.Payment
+	if err := json.Unmarshal([]byte(exec("-json", "pay", "1", "300", "auto")), &payment); err != nil {
+		t.Fatal(err)
+	}
+	exec("pay", "1", "200", "food")
+	exec("reject", payment.ID)
+
+	if err := run([]string{"-data", dir, "deposit", "1", "0"}, &bytes.Buffer{}); err == nil {
+		t.Fatal("deposit of zero amount succeeded")
+	}
+	out := exec("history", "1")
+	if !strings.Contains(out, payment.ID) || !strings.Contains(out, string(types.PaymentStatusFail)) {
+		t.Errorf("history = %q, want rejected payment %v", out, payment.ID)
+	}
+	if out := exec("sum"); strings.TrimSpace(out) != "500" {
+		t.Errorf("sum = %q, want 500", out)
+	}
+
+	dumps := t.TempDir()
+	exec("export", dumps)
+	if out := exec("validate", dumps); out != "" {
+		t.Errorf("validate = %q, want no issues", out)
+	}
+
+	exported := t.TempDir()
+	exec("-format", "json", "export", exported)
+	other := t.TempDir()
+	if err := run([]string{"-data", other, "-format", "json", "import", exported}, &bytes.Buffer{}); err != nil {
+		t.Fatal(err)
+	}
+	buf := &bytes.Buffer{}
+	if err := run([]string{"-data", other, "-json", "history", "1"}, buf); err != nil {
+		t.Fatal(err)
+	}
+	var payments []types.Payment
+	if err := json.Unmarshal(buf.Bytes(), &payments); err != nil {
+		t.Fatal(err)
+	}
+	if len(payments) != 2 {
+		t.Errorf("imported payments = %v, want 2", len(payments))
+	}
+}
+
+func TestRun_usage(t *testing.T) {
+	tests := [][]string{
+		{},
+		{"unknown"},
+		{"pay", "1"},
+		{"-unknown", "sum"},
+	}
+	for _, args := range tests {
+		if err := run(append([]string{"-data", t.TempDir()}, args...), &bytes.Buffer{}); err != errUsage {
+			t.Errorf("run(%v) = %v, want %v", args, err, errUsage)
+		}
+	}
+}
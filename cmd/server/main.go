@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/ilhom0258/wallet/pkg/server"
+	"github.com/ilhom0258/wallet/pkg/wallet"
+)
+
+func main() {
+	addr := flag.String("addr", ":9999", "address to listen on")
+	journal := flag.String("journal", "wallet.journal", "file which keeps service data")
+	exportDir := flag.String("export", "data", "directory for POST /export")
+	flag.Parse()
+
+	repo, err := wallet.OpenFileRepository(*journal)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer func() {
+		if err := repo.Close(); err != nil {
+			log.Print(err)
+		}
+	}()
+
+	srv := &http.Server{
+		Addr:    *addr,
+		Handler: server.New(wallet.NewService(repo), *exportDir),
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+		<-signals
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := srv.Shutdown(ctx); err != nil {
+			log.Print(err)
+		}
+	}()
+
+	log.Printf("listening on %v", *addr)
+	if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+		log.Print(err)
+		return
+	}
+	<-done
+}
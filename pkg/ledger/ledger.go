@@ -0,0 +1,145 @@
+// Package ledger implements double-entry bookkeeping for wallet balances.
+//
+// Every change of money is a journal Entry which consists of at least two
+// legs. A leg with positive amount debits its account (money comes in), a leg
+// with negative amount credits it (money goes out). Legs of an entry always
+// sum to zero, so money is never created or lost, only moved between wallet
+// accounts and system accounts.
+package ledger
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/ilhom0258/wallet/pkg/types"
+)
+
+// System accounts of the ledger
+const (
+	// CashIn is the source of deposited money
+	CashIn = "cash-in"
+	// MerchantClearing receives money of payments
+	MerchantClearing = "merchant-clearing"
+	// OpeningBalance is the source of balances loaded by imports
+	OpeningBalance = "opening-balance"
+)
+
+const walletPrefix = "wallet:"
+
+// Kind describes operation which made an entry
+type Kind string
+
+// Kinds of entries
+const (
+	KindDeposit    Kind = "DEPOSIT"
+	KindPayment    Kind = "PAYMENT"
+	KindRefund     Kind = "REFUND"
+	KindTransfer   Kind = "TRANSFER"
+	KindAdjustment Kind = "ADJUSTMENT"
+)
+
+// ErrEmptyEntry is returned for entries with less than two legs
+var ErrEmptyEntry = errors.New("entry must have at least two legs")
+
+// ErrUnbalanced is returned for entries which legs don't sum to zero
+var ErrUnbalanced = errors.New("entry is not balanced")
+
+// ErrZeroLeg is returned for legs without amount or account
+var ErrZeroLeg = errors.New("leg must have account and non-zero amount")
+
+// Leg is a movement of money into (positive) or out of (negative) an account
+type Leg struct {
+	Account string      `json:"account"`
+	Amount  types.Money `json:"amount"`
+}
+
+// Entry is a balanced journal entry
+type Entry struct {
+	ID        string    `json:"id"`
+	Kind      Kind      `json:"kind"`
+	PaymentID string    `json:"payment_id,omitempty"`
+	Legs      []Leg     `json:"legs"`
+	At        time.Time `json:"at"`
+}
+
+// Wallet returns name of ledger account for wallet account
+func Wallet(accountID int64) string {
+	return walletPrefix + strconv.FormatInt(accountID, 10)
+}
+
+// WalletID returns ID of wallet account by its ledger account name
+func WalletID(account string) (int64, bool) {
+	if !strings.HasPrefix(account, walletPrefix) {
+		return 0, false
+	}
+	id, err := strconv.ParseInt(strings.TrimPrefix(account, walletPrefix), 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return id, true
+}
+
+// Move creates entry posted at the given time which moves amount from one
+// account to another
+func Move(kind Kind, paymentID string, from string, to string, amount types.Money, at time.Time) *Entry {
+	return &Entry{
+		ID:        uuid.New().String(),
+		Kind:      kind,
+		PaymentID: paymentID,
+		Legs: []Leg{
+			{Account: from, Amount: -amount},
+			{Account: to, Amount: amount},
+		},
+		At: at,
+	}
+}
+
+// Validate checks that entry is balanced
+func (e *Entry) Validate() error {
+	if len(e.Legs) < 2 {
+		return ErrEmptyEntry
+	}
+	sum := types.Money(0)
+	for _, leg := range e.Legs {
+		if leg.Account == "" || leg.Amount == 0 {
+			return ErrZeroLeg
+		}
+		sum += leg.Amount
+	}
+	if sum != 0 {
+		return ErrUnbalanced
+	}
+	return nil
+}
+
+// Amount returns sum of entry legs of the account
+func (e *Entry) Amount(account string) types.Money {
+	sum := types.Money(0)
+	for _, leg := range e.Legs {
+		if leg.Account == account {
+			sum += leg.Amount
+		}
+	}
+	return sum
+}
+
+// Copy returns copy of the entry which doesn't share legs with it
+func (e *Entry) Copy() Entry {
+	result := *e
+	result.Legs = append([]Leg(nil), e.Legs...)
+	return result
+}
+
+// Balances calculates balances of all accounts mentioned in entries
+func Balances(entries []*Entry) map[string]types.Money {
+	balances := make(map[string]types.Money)
+	for _, entry := range entries {
+		for _, leg := range entry.Legs {
+			balances[leg.Account] += leg.Amount
+		}
+	}
+	return balances
+}
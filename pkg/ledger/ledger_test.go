@@ -0,0 +1,56 @@
+package ledger
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ilhom0258/wallet/pkg/types"
+)
+
+func TestEntry_Validate(t *testing.T) {
+	tests := []struct {
+		name  string
+		entry Entry
+		want  error
+	}{
+		{"balanced", *Move(KindDeposit, "", CashIn, Wallet(1), 100, time.Time{}), nil},
+		{"empty", Entry{Legs: []Leg{{Account: CashIn, Amount: 1}}}, ErrEmptyEntry},
+		{"zero", Entry{Legs: []Leg{{Account: CashIn}, {Account: Wallet(1)}}}, ErrZeroLeg},
+		{"unbalanced", Entry{Legs: []Leg{{Account: CashIn, Amount: -1}, {Account: Wallet(1), Amount: 2}}}, ErrUnbalanced},
+	}
+	for _, test := range tests {
+		if err := test.entry.Validate(); err != test.want {
+			t.Errorf("%v: err = %v, want %v", test.name, err, test.want)
+		}
+	}
+}
+
+func TestBalances(t *testing.T) {
+	entries := []*Entry{
+		Move(KindDeposit, "", CashIn, Wallet(1), 100, time.Time{}),
+		Move(KindPayment, "p1", Wallet(1), MerchantClearing, 30, time.Time{}),
+		Move(KindTransfer, "p2", Wallet(1), Wallet(2), 20, time.Time{}),
+	}
+	balances := Balances(entries)
+	want := map[string]types.Money{
+		CashIn:           -100,
+		MerchantClearing: 30,
+		Wallet(1):        50,
+		Wallet(2):        20,
+	}
+	for account, balance := range want {
+		if balances[account] != balance {
+			t.Errorf("%v balance = %v, want %v", account, balances[account], balance)
+		}
+	}
+	if entries[2].Amount(Wallet(2)) != 20 {
+		t.Errorf("amount = %v, want 20", entries[2].Amount(Wallet(2)))
+	}
+	id, ok := WalletID(Wallet(42))
+	if !ok || id != 42 {
+		t.Errorf("WalletID = %v, %v", id, ok)
+	}
+	if _, ok := WalletID(CashIn); ok {
+		t.Errorf("%v is not a wallet", CashIn)
+	}
+}
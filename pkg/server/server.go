@@ -0,0 +1,347 @@
+// Package server exposes wallet.Service as JSON REST API.
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ilhom0258/wallet/pkg/types"
+	"github.com/ilhom0258/wallet/pkg/wallet"
+)
+
+// IdempotencyKeyHeader carries idempotency key of deposits and payments
+const IdempotencyKeyHeader = "Idempotency-Key"
+
+// errBadRequest is returned for malformed requests
+var errBadRequest = errors.New("bad request")
+
+// Server is http.Handler serving wallet API:
+//
+//	POST /accounts                    register account {"phone"}
+//	GET  /accounts/{id}               account
+//	POST /accounts/{id}/deposits      deposit {"amount"}
+//	GET  /accounts/{id}/payments      history, optional ?from=&to= in RFC 3339
+//	GET  /accounts/{id}/favorites     favorites
+//	POST /payments                    pay {"account_id", "amount", "category"}
+//	POST /payments/{id}/reject        reject payment
+//	POST /payments/{id}/confirm       confirm payment
+//	POST /payments/{id}/complete      complete payment
+//	POST /payments/{id}/repeat        repeat payment
+//	GET  /payments/{id}/history       status changes of payment
+//	POST /payments/{id}/favorite      add favorite {"name"}
+//	POST /favorites/{id}/pay          pay from favorite
+//	POST /transfers                   transfer {"from_id", "to_id" or "to_phone", "amount"}
+//	POST /export                      export service data to the export directory
+//
+// Deposits and payments accept Idempotency-Key header.
+type Server struct {
+	svc       *wallet.Service
+	exportDir string
+	routes    []route
+}
+
+type route struct {
+	method  string
+	pattern []string
+	handler func(w http.ResponseWriter, r *http.Request, params []string)
+}
+
+// New creates server for svc, POST /export writes dumps to exportDir
+func New(svc *wallet.Service, exportDir string) *Server {
+	s := &Server{svc: svc, exportDir: exportDir}
+	s.routes = []route{
+		{http.MethodPost, []string{"accounts"}, s.handleRegister},
+		{http.MethodGet, []string{"accounts", "*"}, s.handleAccount},
+		{http.MethodPost, []string{"accounts", "*", "deposits"}, s.handleDeposit},
+		{http.MethodGet, []string{"accounts", "*", "payments"}, s.handleHistory},
+		{http.MethodGet, []string{"accounts", "*", "favorites"}, s.handleFavorites},
+		{http.MethodPost, []string{"payments"}, s.handlePay},
+		{http.MethodPost, []string{"payments", "*", "reject"}, s.handleReject},
+		{http.MethodPost, []string{"payments", "*", "confirm"}, s.handleConfirm},
+		{http.MethodPost, []string{"payments", "*", "complete"}, s.handleComplete},
+		{http.MethodPost, []string{"payments", "*", "repeat"}, s.handleRepeat},
+		{http.MethodGet, []string{"payments", "*", "history"}, s.handlePaymentHistory},
+		{http.MethodPost, []string{"payments", "*", "favorite"}, s.handleFavorite},
+		{http.MethodPost, []string{"favorites", "*", "pay"}, s.handlePayFromFavorite},
+		{http.MethodPost, []string{"transfers"}, s.handleTransfer},
+		{http.MethodPost, []string{"export"}, s.handleExport},
+	}
+	return s
+}
+
+// ServeHTTP dispatches request to its handler
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	segments := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	found := false
+	for _, route := range s.routes {
+		params, ok := match(route.pattern, segments)
+		if !ok {
+			continue
+		}
+		found = true
+		if route.method == r.Method {
+			route.handler(w, r, params)
+			return
+		}
+	}
+	if found {
+		writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return
+	}
+	writeError(w, http.StatusNotFound, errors.New("not found"))
+}
+
+func (s *Server) handleRegister(w http.ResponseWriter, r *http.Request, params []string) {
+	var request struct {
+		Phone types.Phone `json:"phone"`
+	}
+	if !decode(w, r, &request) {
+		return
+	}
+	if request.Phone == "" {
+		writeError(w, http.StatusBadRequest, errors.New("phone is required"))
+		return
+	}
+	account, err := s.svc.RegisterAccount(request.Phone)
+	respond(w, http.StatusCreated, account, err)
+}
+
+func (s *Server) handleAccount(w http.ResponseWriter, r *http.Request, params []string) {
+	id, ok := accountID(w, params[0])
+	if !ok {
+		return
+	}
+	account, err := s.svc.FindAccountByID(id)
+	respond(w, http.StatusOK, account, err)
+}
+
+func (s *Server) handleDeposit(w http.ResponseWriter, r *http.Request, params []string) {
+	id, ok := accountID(w, params[0])
+	if !ok {
+		return
+	}
+	var request struct {
+		Amount types.Money `json:"amount"`
+	}
+	if !decode(w, r, &request) {
+		return
+	}
+	err := s.svc.DepositWithKey(r.Header.Get(IdempotencyKeyHeader), id, request.Amount)
+	if err != nil {
+		respond(w, 0, nil, err)
+		return
+	}
+	account, err := s.svc.FindAccountByID(id)
+	respond(w, http.StatusOK, account, err)
+}
+
+func (s *Server) handleHistory(w http.ResponseWriter, r *http.Request, params []string) {
+	id, ok := accountID(w, params[0])
+	if !ok {
+		return
+	}
+	from, err := queryTime(r, "from")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	to, err := queryTime(r, "to")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	payments, err := s.svc.AccountPaymentsInRange(id, from, to)
+	respond(w, http.StatusOK, payments, err)
+}
+
+func (s *Server) handleFavorites(w http.ResponseWriter, r *http.Request, params []string) {
+	id, ok := accountID(w, params[0])
+	if !ok {
+		return
+	}
+	favorites, err := s.svc.AccountFavorites(id)
+	respond(w, http.StatusOK, favorites, err)
+}
+
+func (s *Server) handlePay(w http.ResponseWriter, r *http.Request, params []string) {
+	var request struct {
+		AccountID int64                 `json:"account_id"`
+		Amount    types.Money           `json:"amount"`
+		Category  types.PaymentCategory `json:"category"`
+	}
+	if !decode(w, r, &request) {
+		return
+	}
+	key := r.Header.Get(IdempotencyKeyHeader)
+	payment, err := s.svc.PayWithKey(key, request.AccountID, request.Amount, request.Category)
+	respond(w, http.StatusCreated, payment, err)
+}
+
+func (s *Server) handleReject(w http.ResponseWriter, r *http.Request, params []string) {
+	respond(w, http.StatusNoContent, nil, s.svc.Reject(params[0]))
+}
+
+func (s *Server) handleConfirm(w http.ResponseWriter, r *http.Request, params []string) {
+	respond(w, http.StatusNoContent, nil, s.svc.Confirm(params[0]))
+}
+
+func (s *Server) handleComplete(w http.ResponseWriter, r *http.Request, params []string) {
+	respond(w, http.StatusNoContent, nil, s.svc.Complete(params[0]))
+}
+
+func (s *Server) handleRepeat(w http.ResponseWriter, r *http.Request, params []string) {
+	payment, err := s.svc.RepeatWithKey(r.Header.Get(IdempotencyKeyHeader), params[0])
+	respond(w, http.StatusCreated, payment, err)
+}
+
+func (s *Server) handlePaymentHistory(w http.ResponseWriter, r *http.Request, params []string) {
+	history, err := s.svc.PaymentHistory(params[0])
+	respond(w, http.StatusOK, history, err)
+}
+
+func (s *Server) handleFavorite(w http.ResponseWriter, r *http.Request, params []string) {
+	var request struct {
+		Name string `json:"name"`
+	}
+	if !decode(w, r, &request) {
+		return
+	}
+	favorite, err := s.svc.FavoritePayment(params[0], request.Name)
+	respond(w, http.StatusCreated, favorite, err)
+}
+
+func (s *Server) handlePayFromFavorite(w http.ResponseWriter, r *http.Request, params []string) {
+	payment, err := s.svc.PayFromFavoriteWithKey(r.Header.Get(IdempotencyKeyHeader), params[0])
+	respond(w, http.StatusCreated, payment, err)
+}
+
+func (s *Server) handleTransfer(w http.ResponseWriter, r *http.Request, params []string) {
+	var request struct {
+		FromID  int64       `json:"from_id"`
+		ToID    int64       `json:"to_id"`
+		ToPhone types.Phone `json:"to_phone"`
+		Amount  types.Money `json:"amount"`
+	}
+	if !decode(w, r, &request) {
+		return
+	}
+	var payment *types.Payment
+	var err error
+	if request.ToPhone != "" {
+		payment, err = s.svc.TransferByPhone(request.FromID, request.ToPhone, request.Amount)
+	} else {
+		payment, err = s.svc.Transfer(request.FromID, request.ToID, request.Amount)
+	}
+	respond(w, http.StatusCreated, payment, err)
+}
+
+func (s *Server) handleExport(w http.ResponseWriter, r *http.Request, params []string) {
+	respond(w, http.StatusNoContent, nil, s.svc.ExportContext(r.Context(), s.exportDir))
+}
+
+// match compares path segments with pattern, "*" matches any segment and is
+// returned in params
+func match(pattern []string, segments []string) ([]string, bool) {
+	if len(pattern) != len(segments) {
+		return nil, false
+	}
+	var params []string
+	for i, part := range pattern {
+		if part == "*" {
+			params = append(params, segments[i])
+			continue
+		}
+		if part != segments[i] {
+			return nil, false
+		}
+	}
+	return params, true
+}
+
+func accountID(w http.ResponseWriter, param string) (int64, bool) {
+	id, err := strconv.ParseInt(param, 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errors.New("invalid account id"))
+		return 0, false
+	}
+	return id, true
+}
+
+func queryTime(r *http.Request, name string) (time.Time, error) {
+	value := r.URL.Query().Get(name)
+	if value == "" {
+		return time.Time{}, nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+func decode(w http.ResponseWriter, r *http.Request, request interface{}) bool {
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(request); err != nil {
+		writeError(w, http.StatusBadRequest, errBadRequest)
+		return false
+	}
+	return true
+}
+
+// respond writes body with status or error mapped to its status
+func respond(w http.ResponseWriter, status int, body interface{}, err error) {
+	if err != nil {
+		writeError(w, StatusCode(err), err)
+		return
+	}
+	if status == http.StatusNoContent {
+		w.WriteHeader(status)
+		return
+	}
+	writeJSON(w, status, body)
+}
+
+// StatusCode maps errors of wallet package to HTTP status codes
+func StatusCode(err error) int {
+	switch {
+	case errors.Is(err, wallet.ErrAccountNotFound),
+		errors.Is(err, wallet.ErrPaymentNotFound),
+		errors.Is(err, wallet.ErrFavoriteNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, wallet.ErrAmountMustBePositive),
+		errors.Is(err, wallet.ErrTransferToSameAccount),
+		errors.Is(err, errBadRequest):
+		return http.StatusBadRequest
+	case errors.Is(err, wallet.ErrPhoneRegistered),
+		errors.Is(err, wallet.ErrInvalidTransition),
+		errors.Is(err, wallet.ErrIdempotencyKeyReused):
+		return http.StatusConflict
+	case errors.Is(err, wallet.ErrNotEnoughBalance),
+		errors.Is(err, wallet.ErrTransferPayment):
+		return http.StatusUnprocessableEntity
+	case errors.Is(err, context.DeadlineExceeded):
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	message := err.Error()
+	if status == http.StatusInternalServerError {
+		log.Print(err)
+		message = http.StatusText(status)
+	}
+	writeJSON(w, status, map[string]string{"error": message})
+}
+
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		log.Print(err)
+	}
+}
@@ -0,0 +1,127 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/ilhom0258/wallet/pkg/types"
+	"github.com/ilhom0258/wallet/pkg/wallet"
+)
+
+func TestServer_paymentFlow(t *testing.T) {
+	svc := &wallet.Service{}
+	srv := httptest.NewServer(New(svc, t.TempDir()))
+	defer srv.Close()
+
+	var account types.Account
+	call(t, srv, http.MethodPost, "/accounts", "", `{"phone":"+992000000001"}`, http.StatusCreated, &account)
+	call(t, srv, http.MethodPost, "/accounts", "", `{"phone":"+992000000001"}`, http.StatusConflict, nil)
+	call(t, srv, http.MethodPost, "/accounts/1/deposits", "key-1", `{"amount":1000}`, http.StatusOK, &account)
+	call(t, srv, http.MethodPost, "/accounts/1/deposits", "key-1", `{"amount":1000}`, http.StatusOK, &account)
+	if account.Balance != 1000 {
+		t.Errorf("balance = %v, want 1000", account.Balance)
+	}
+
+	var payment types.Payment
+	call(t, srv, http.MethodPost, "/payments", "", `{"account_id":1,"amount":100,"category":"auto"}`, http.StatusCreated, &payment)
+	call(t, srv, http.MethodPost, "/payments", "", `{"account_id":1,"amount":5000,"category":"auto"}`, http.StatusUnprocessableEntity, nil)
+	call(t, srv, http.MethodPost, "/payments", "", `{"account_id":2,"amount":10,"category":"auto"}`, http.StatusNotFound, nil)
+	call(t, srv, http.MethodPost, "/payments", "", `{"account_id":1,"amount":0,"category":"auto"}`, http.StatusBadRequest, nil)
+
+	var favorite types.Favorite
+	call(t, srv, http.MethodPost, "/payments/"+payment.ID+"/favorite", "", `{"name":"car"}`, http.StatusCreated, &favorite)
+	var repeated types.Payment
+	call(t, srv, http.MethodPost, "/favorites/"+favorite.ID+"/pay", "", "", http.StatusCreated, &repeated)
+	call(t, srv, http.MethodPost, "/payments/"+payment.ID+"/repeat", "", "", http.StatusCreated, &repeated)
+	call(t, srv, http.MethodPost, "/payments/"+payment.ID+"/reject", "", "", http.StatusNoContent, nil)
+	call(t, srv, http.MethodPost, "/payments/"+payment.ID+"/reject", "", "", http.StatusConflict, nil)
+	call(t, srv, http.MethodPost, "/payments/"+repeated.ID+"/confirm", "", "", http.StatusNoContent, nil)
+	call(t, srv, http.MethodPost, "/payments/"+repeated.ID+"/complete", "", "", http.StatusNoContent, nil)
+
+	var history []types.PaymentTransition
+	call(t, srv, http.MethodGet, "/payments/"+repeated.ID+"/history", "", "", http.StatusOK, &history)
+	if len(history) != 3 {
+		t.Errorf("history = %v, want 3 transitions", history)
+	}
+	var payments []types.Payment
+	call(t, srv, http.MethodGet, "/accounts/1/payments", "", "", http.StatusOK, &payments)
+	if len(payments) != 3 {
+		t.Errorf("payments = %v, want 3", len(payments))
+	}
+	var favorites []types.Favorite
+	call(t, srv, http.MethodGet, "/accounts/1/favorites", "", "", http.StatusOK, &favorites)
+	if len(favorites) != 1 {
+		t.Errorf("favorites = %v, want 1", len(favorites))
+	}
+	call(t, srv, http.MethodGet, "/accounts/1", "", "", http.StatusOK, &account)
+	if account.Balance != 800 {
+		t.Errorf("balance = %v, want 800", account.Balance)
+	}
+
+	call(t, srv, http.MethodPost, "/accounts", "", `{"phone":"+992000000002"}`, http.StatusCreated, nil)
+	var transfer types.Payment
+	call(t, srv, http.MethodPost, "/transfers", "", `{"from_id":1,"to_phone":"+992000000002","amount":300}`, http.StatusCreated, &transfer)
+	call(t, srv, http.MethodPost, "/payments/"+transfer.ID+"/reject", "", "", http.StatusUnprocessableEntity, nil)
+	call(t, srv, http.MethodPost, "/transfers", "", `{"from_id":1,"to_id":1,"amount":300}`, http.StatusBadRequest, nil)
+	call(t, srv, http.MethodPost, "/export", "", "", http.StatusNoContent, nil)
+}
+
+func TestServer_routing(t *testing.T) {
+	srv := httptest.NewServer(New(&wallet.Service{}, t.TempDir()))
+	defer srv.Close()
+
+	call(t, srv, http.MethodGet, "/unknown", "", "", http.StatusNotFound, nil)
+	call(t, srv, http.MethodDelete, "/accounts/1", "", "", http.StatusMethodNotAllowed, nil)
+	call(t, srv, http.MethodGet, "/accounts/abc", "", "", http.StatusBadRequest, nil)
+	call(t, srv, http.MethodGet, "/accounts/1", "", "", http.StatusNotFound, nil)
+	call(t, srv, http.MethodPost, "/accounts", "", `{"phone":`, http.StatusBadRequest, nil)
+	call(t, srv, http.MethodGet, "/accounts/1/payments?from=yesterday", "", "", http.StatusBadRequest, nil)
+}
+
+func TestStatusCode(t *testing.T) {
+	tests := []struct {
+		err  error
+		want int
+	}{
+		{wallet.ErrFavoriteNotFound, http.StatusNotFound},
+		{wallet.ErrIdempotencyKeyReused, http.StatusConflict},
+		{&wallet.TransitionError{}, http.StatusConflict},
+		{fmt.Errorf("export: %w", context.DeadlineExceeded), http.StatusServiceUnavailable},
+		{errors.New("disk is full"), http.StatusInternalServerError},
+	}
+	for _, test := range tests {
+		if got := StatusCode(test.err); got != test.want {
+			t.Errorf("StatusCode(%v) = %v, want %v", test.err, got, test.want)
+		}
+	}
+}
+
+func call(t *testing.T, srv *httptest.Server, method string, path string, key string, body string, status int, result interface{}) {
+	t.Helper()
+	request, err := http.NewRequest(method, srv.URL+path, bytes.NewBufferString(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key != "" {
+		request.Header.Set(IdempotencyKeyHeader, key)
+	}
+	response, err := srv.Client().Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	if response.StatusCode != status {
+		t.Fatalf("%v %v status = %v, want %v", method, path, response.StatusCode, status)
+	}
+	if result != nil {
+		if err := json.NewDecoder(response.Body).Decode(result); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
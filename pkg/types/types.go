@@ -1,5 +1,7 @@
 package types
 
+import "time"
+
 // Money is defined as minimal sum for money in cents, dirams...
 type Money int64
 
@@ -14,15 +16,47 @@ const (
 	PaymentStatusOk         PaymentStatus = "OK"
 	PaymentStatusFail       PaymentStatus = "FAIL"
 	PaymentStatusInProgress PaymentStatus = "INPROGRESS"
+	PaymentStatusConfirmed  PaymentStatus = "CONFIRMED"
+)
+
+// PaymentEvent is an action which changes status of the payment
+type PaymentEvent string
+
+// Events of payment lifecycle
+const (
+	PaymentEventCreate   PaymentEvent = "CREATE"
+	PaymentEventConfirm  PaymentEvent = "CONFIRM"
+	PaymentEventComplete PaymentEvent = "COMPLETE"
+	PaymentEventReject   PaymentEvent = "REJECT"
+)
+
+// PaymentTransition is a record about change of payment status
+type PaymentTransition struct {
+	PaymentID string        `json:"payment_id"`
+	Event     PaymentEvent  `json:"event"`
+	From      PaymentStatus `json:"from,omitempty"`
+	To        PaymentStatus `json:"to"`
+	At        time.Time     `json:"at"`
+}
+
+// Categories of payments made by transfers between accounts
+const (
+	PaymentCategoryTransferOut PaymentCategory = "transfer_out"
+	PaymentCategoryTransferIn  PaymentCategory = "transfer_in"
 )
 
 //Payment defines paymnet information
 type Payment struct {
-	ID        string
-	AccountID int64
-	Amount    Money
-	Category  PaymentCategory
-	Status    PaymentStatus
+	ID        string          `json:"id"`
+	AccountID int64           `json:"account_id"`
+	Amount    Money           `json:"amount"`
+	Category  PaymentCategory `json:"category"`
+	Status    PaymentStatus   `json:"status"`
+	// LinkedID is ID of the opposite payment of a transfer
+	LinkedID string    `json:"linked_id,omitempty"`
+	Created  time.Time `json:"created"`
+	// Updated is time of the last status change
+	Updated time.Time `json:"updated"`
 }
 
 // Phone - phone number of the user
@@ -30,16 +64,16 @@ type Phone string
 
 // Account defines account information of a user
 type Account struct {
-	ID      int64
-	Phone   Phone
-	Balance Money
+	ID      int64 `json:"id"`
+	Phone   Phone `json:"phone"`
+	Balance Money `json:"balance"`
 }
 
 // Favorite define favorite payment for user
 type Favorite struct {
-	ID        string
-	AccountID int64
-	Name      string
-	Amount    Money
-	Category  PaymentCategory
+	ID        string          `json:"id"`
+	AccountID int64           `json:"account_id"`
+	Name      string          `json:"name"`
+	Amount    Money           `json:"amount"`
+	Category  PaymentCategory `json:"category"`
 }
@@ -0,0 +1,248 @@
+package wallet
+
+import (
+	"context"
+	"sync"
+
+	"github.com/ilhom0258/wallet/pkg/types"
+)
+
+// Parallel configures how payments are split between goroutines
+type Parallel struct {
+	// Goroutines is number of parts processed at once, payments are split
+	// into parts of nearly equal size. Values below 2 process payments in
+	// the calling goroutine.
+	Goroutines int
+	// Ordered merges results of parts in order of payments, otherwise they
+	// are merged as soon as parts finish
+	Ordered bool
+}
+
+// Reducer folds payments into a result. Every part of payments is folded
+// into its own result started by Zero, results of parts are combined by
+// Merge. Fold and Merge may return the accumulator they got. Payments are
+// folded from a snapshot after the service lock is released, so functions
+// may call methods of the service.
+type Reducer struct {
+	Zero  func() interface{}
+	Fold  func(acc interface{}, payment types.Payment) interface{}
+	Merge func(acc interface{}, part interface{}) interface{}
+}
+
+// PaymentStats summarizes a set of payments, Min and Max are zero for empty set
+type PaymentStats struct {
+	Count int
+	Sum   types.Money
+	Min   types.Money
+	Max   types.Money
+}
+
+func (p *PaymentStats) add(payment types.Payment) {
+	if p.Count == 0 || payment.Amount < p.Min {
+		p.Min = payment.Amount
+	}
+	if p.Count == 0 || payment.Amount > p.Max {
+		p.Max = payment.Amount
+	}
+	p.Count++
+	p.Sum += payment.Amount
+}
+
+func (p *PaymentStats) merge(other PaymentStats) {
+	if other.Count == 0 {
+		return
+	}
+	if p.Count == 0 || other.Min < p.Min {
+		p.Min = other.Min
+	}
+	if p.Count == 0 || other.Max > p.Max {
+		p.Max = other.Max
+	}
+	p.Count += other.Count
+	p.Sum += other.Sum
+}
+
+// ReducePayments folds all payments of the service with reducer
+func (s *Service) ReducePayments(parallel Parallel, reducer Reducer) interface{} {
+	result, _ := s.ReducePaymentsContext(context.Background(), parallel, reducer)
+	return result
+}
+
+// ReducePaymentsContext folds payments like ReducePayments and stops when
+// ctx is done
+func (s *Service) ReducePaymentsContext(ctx context.Context, parallel Parallel, reducer Reducer) (interface{}, error) {
+	return reducePayments(ctx, s.snapshotPayments(), parallel, reducer)
+}
+
+// AggregatePayments returns stats of payments matching filter, nil filter
+// matches all payments
+func (s *Service) AggregatePayments(parallel Parallel, filter func(payment types.Payment) bool) PaymentStats {
+	stats, _ := s.AggregatePaymentsContext(context.Background(), parallel, filter)
+	return stats
+}
+
+// AggregatePaymentsContext returns stats like AggregatePayments and stops
+// when ctx is done
+func (s *Service) AggregatePaymentsContext(ctx context.Context, parallel Parallel, filter func(payment types.Payment) bool) (PaymentStats, error) {
+	return aggregatePayments(ctx, s.snapshotPayments(), parallel, filter)
+}
+
+// GroupPayments returns stats of payments grouped by key
+func (s *Service) GroupPayments(parallel Parallel, key func(payment types.Payment) string) map[string]PaymentStats {
+	groups, _ := s.GroupPaymentsContext(context.Background(), parallel, key)
+	return groups
+}
+
+// GroupPaymentsContext returns stats like GroupPayments and stops when ctx
+// is done
+func (s *Service) GroupPaymentsContext(ctx context.Context, parallel Parallel, key func(payment types.Payment) string) (map[string]PaymentStats, error) {
+	return groupPayments(ctx, s.snapshotPayments(), parallel, key)
+}
+
+func aggregatePayments(ctx context.Context, payments []*types.Payment, parallel Parallel, filter func(payment types.Payment) bool) (PaymentStats, error) {
+	stats, err := reducePayments(ctx, payments, parallel, Reducer{
+		Zero: func() interface{} {
+			return &PaymentStats{}
+		},
+		Fold: func(acc interface{}, payment types.Payment) interface{} {
+			if filter == nil || filter(payment) {
+				acc.(*PaymentStats).add(payment)
+			}
+			return acc
+		},
+		Merge: func(acc interface{}, part interface{}) interface{} {
+			acc.(*PaymentStats).merge(*part.(*PaymentStats))
+			return acc
+		},
+	})
+	if err != nil {
+		return PaymentStats{}, err
+	}
+	return *stats.(*PaymentStats), nil
+}
+
+func groupPayments(ctx context.Context, payments []*types.Payment, parallel Parallel, key func(payment types.Payment) string) (map[string]PaymentStats, error) {
+	groups, err := reducePayments(ctx, payments, parallel, Reducer{
+		Zero: func() interface{} {
+			return map[string]*PaymentStats{}
+		},
+		Fold: func(acc interface{}, payment types.Payment) interface{} {
+			groups := acc.(map[string]*PaymentStats)
+			k := key(payment)
+			if groups[k] == nil {
+				groups[k] = &PaymentStats{}
+			}
+			groups[k].add(payment)
+			return groups
+		},
+		Merge: func(acc interface{}, part interface{}) interface{} {
+			groups := acc.(map[string]*PaymentStats)
+			for k, stats := range part.(map[string]*PaymentStats) {
+				if groups[k] == nil {
+					groups[k] = &PaymentStats{}
+				}
+				groups[k].merge(*stats)
+			}
+			return groups
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	result := make(map[string]PaymentStats, len(groups.(map[string]*PaymentStats)))
+	for k, stats := range groups.(map[string]*PaymentStats) {
+		result[k] = *stats
+	}
+	return result, nil
+}
+
+// filterPayments returns copies of payments matching filter in their order
+func filterPayments(ctx context.Context, payments []*types.Payment, goroutines int, filter func(payment types.Payment) bool) ([]types.Payment, error) {
+	filtered, err := reducePayments(ctx, payments, Parallel{Goroutines: goroutines, Ordered: true}, Reducer{
+		Zero: func() interface{} {
+			return []types.Payment{}
+		},
+		Fold: func(acc interface{}, payment types.Payment) interface{} {
+			if filter(payment) {
+				return append(acc.([]types.Payment), payment)
+			}
+			return acc
+		},
+		Merge: func(acc interface{}, part interface{}) interface{} {
+			return append(acc.([]types.Payment), part.([]types.Payment)...)
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return filtered.([]types.Payment), nil
+}
+
+// reducePayments splits payments into parallel.Goroutines parts, folds them
+// concurrently and merges their results. Folding stops when ctx is done.
+// Caller must hold the lock.
+func reducePayments(ctx context.Context, payments []*types.Payment, parallel Parallel, reducer Reducer) (interface{}, error) {
+	type result struct {
+		acc interface{}
+		err error
+	}
+	fold := func(part []*types.Payment) result {
+		acc := reducer.Zero()
+		for i, payment := range part {
+			if err := interrupted(ctx, i); err != nil {
+				return result{err: err}
+			}
+			acc = reducer.Fold(acc, *payment)
+		}
+		return result{acc: acc}
+	}
+	if parallel.Goroutines < 2 {
+		r := fold(payments)
+		return r.acc, r.err
+	}
+
+	parts := splitPayments(payments, parallel.Goroutines)
+	acc := reducer.Zero()
+	if parallel.Ordered {
+		results := make([]result, len(parts))
+		wg := sync.WaitGroup{}
+		for i, part := range parts {
+			wg.Add(1)
+			go func(i int, part []*types.Payment) {
+				defer wg.Done()
+				results[i] = fold(part)
+			}(i, part)
+		}
+		wg.Wait()
+		for _, r := range results {
+			if r.err != nil {
+				return nil, r.err
+			}
+			acc = reducer.Merge(acc, r.acc)
+		}
+		return acc, nil
+	}
+
+	results := make(chan result, len(parts))
+	for _, part := range parts {
+		go func(part []*types.Payment) {
+			results <- fold(part)
+		}(part)
+	}
+	// all parts are received even after an error, so none of them reads
+	// payments after the caller releases the lock
+	var err error
+	for range parts {
+		r := <-results
+		if r.err != nil {
+			err = r.err
+		}
+		if err == nil {
+			acc = reducer.Merge(acc, r.acc)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return acc, nil
+}
@@ -0,0 +1,342 @@
+package wallet
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Exports are written into generation directories inside the export
+// directory and currentLink is switched to the new generation by a single
+// rename, so readers see either the previous or the new export as a whole.
+const (
+	currentLink      = "current"
+	generationPrefix = ".export-"
+	stagingPrefix    = ".staging-"
+)
+
+// dirLocks holds locks of export directories in use. Exports lock their
+// directory to switch generations and imports read lock it, so generations
+// aren't removed while they are read.
+var dirLocks = struct {
+	sync.Mutex
+	locks map[string]*dirLock
+}{locks: make(map[string]*dirLock)}
+
+type dirLock struct {
+	sync.RWMutex
+	users int
+}
+
+// lockDir locks directory at path for writing or reading and returns func
+// which unlocks it
+func lockDir(path string, write bool) func() {
+	dirLocks.Lock()
+	lock := dirLocks.locks[path]
+	if lock == nil {
+		lock = &dirLock{}
+		dirLocks.locks[path] = lock
+	}
+	lock.users++
+	dirLocks.Unlock()
+
+	if write {
+		lock.Lock()
+	} else {
+		lock.RLock()
+	}
+	return func() {
+		if write {
+			lock.Unlock()
+		} else {
+			lock.RUnlock()
+		}
+		dirLocks.Lock()
+		lock.users--
+		if lock.users == 0 {
+			delete(dirLocks.locks, path)
+		}
+		dirLocks.Unlock()
+	}
+}
+
+// exportAtomically calls write with a new hidden staging directory inside
+// dir, turns it into a generation and switches currentLink of dir to it.
+// Files of the previous generation which aren't named in files are linked
+// into the new one, so exports of other formats are kept. The previous
+// generation stays for readers which still use it, older ones are removed.
+// Other contents of dir are never touched.
+//
+// When write fails or ctx is done before the switch, currentLink is left as
+// is. Exports into different directories don't wait for each other.
+func exportAtomically(ctx context.Context, dir string, files []string, write func(staging string) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	path, err := filepath.Abs(dir)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(path, 0777); err != nil {
+		return err
+	}
+	if path, err = filepath.EvalSymlinks(path); err != nil {
+		return err
+	}
+	staging, err := ioutil.TempDir(path, stagingPrefix)
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(staging)
+
+	if err := write(staging); err != nil {
+		return err
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	unlock := lockDir(path, true)
+	defer unlock()
+	previous, err := currentGeneration(path)
+	if err != nil {
+		return err
+	}
+	if previous != "" {
+		if err := linkFiles(filepath.Join(path, previous), staging, files); err != nil {
+			return err
+		}
+	}
+	if err := syncDir(staging); err != nil {
+		return err
+	}
+	generation := generationPrefix + strings.TrimPrefix(filepath.Base(staging), stagingPrefix)
+	if err := os.Rename(staging, filepath.Join(path, generation)); err != nil {
+		return err
+	}
+	if err := switchGeneration(path, generation); err != nil {
+		os.RemoveAll(filepath.Join(path, generation))
+		return err
+	}
+	if err := syncDir(path); err != nil {
+		return err
+	}
+	return removeGenerations(path, generation, previous)
+}
+
+// writeAside calls write with a new hidden staging directory inside dir and
+// renames files it wrote into dir in the returned order, so no file of dir
+// is ever partly written. Then cleanup is called with dir locked against
+// imports. When write fails or ctx is done, dir isn't changed.
+func writeAside(ctx context.Context, dir string, write func(staging string) ([]string, error), cleanup func(path string) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	path, err := filepath.Abs(dir)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(path, 0777); err != nil {
+		return err
+	}
+	if path, err = filepath.EvalSymlinks(path); err != nil {
+		return err
+	}
+	staging, err := ioutil.TempDir(path, stagingPrefix)
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(staging)
+
+	files, err := write(staging)
+	if err != nil {
+		return err
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	unlock := lockDir(path, true)
+	defer unlock()
+	for _, file := range files {
+		if err := os.Rename(filepath.Join(staging, file), filepath.Join(path, file)); err != nil {
+			return err
+		}
+	}
+	if err := cleanup(path); err != nil {
+		return err
+	}
+	return syncDir(path)
+}
+
+// currentGeneration returns name of the generation currentLink of dir
+// points to, dir without the link has no generation
+func currentGeneration(dir string) (string, error) {
+	target, err := os.Readlink(filepath.Join(dir, currentLink))
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil || target != filepath.Base(target) || !strings.HasPrefix(target, generationPrefix) {
+		return "", fmt.Errorf("%w: %v", ErrNotExportDir, filepath.Join(dir, currentLink))
+	}
+	return target, nil
+}
+
+// switchGeneration points currentLink of dir to generation by renaming a
+// new link over it
+func switchGeneration(dir string, generation string) error {
+	link := filepath.Join(dir, stagingPrefix+generation)
+	if err := os.Symlink(generation, link); err != nil {
+		return err
+	}
+	if err := os.Rename(link, filepath.Join(dir, currentLink)); err != nil {
+		os.Remove(link)
+		return err
+	}
+	return nil
+}
+
+// linkFiles hard links files of previous generation into staging, except
+// files which staging has or which are named in skip
+func linkFiles(previous string, staging string, skip []string) error {
+	infos, err := ioutil.ReadDir(previous)
+	if err != nil {
+		return err
+	}
+	skipped := make(map[string]bool)
+	for _, name := range skip {
+		skipped[name] = true
+	}
+	for _, info := range infos {
+		name := info.Name()
+		if skipped[name] || !info.Mode().IsRegular() {
+			continue
+		}
+		err := os.Link(filepath.Join(previous, name), filepath.Join(staging, name))
+		if err != nil && !os.IsExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeGenerations removes generations of dir except the kept ones
+func removeGenerations(dir string, keep ...string) error {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	kept := make(map[string]bool)
+	for _, name := range keep {
+		kept[name] = true
+	}
+	for _, info := range infos {
+		name := info.Name()
+		if !info.IsDir() || kept[name] || !strings.HasPrefix(name, generationPrefix) {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(dir, name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// exportDir is a directory written by exports. Export files are read from
+// generation, the current generation of the directory or the directory
+// itself when it has none, payment history is read from path.
+type exportDir struct {
+	path       string
+	generation string
+	unlock     func()
+}
+
+// openExportDir resolves current generation of dir and read locks dir until
+// Close, so the generation isn't removed by exports meanwhile
+func openExportDir(dir string) (*exportDir, error) {
+	path, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	if path, err = filepath.EvalSymlinks(path); err != nil {
+		return nil, err
+	}
+	unlock := lockDir(path, false)
+	generation, err := currentGeneration(path)
+	if err != nil {
+		unlock()
+		return nil, err
+	}
+	return &exportDir{path: path, generation: filepath.Join(path, generation), unlock: unlock}, nil
+}
+
+// Close unlocks the directory
+func (d *exportDir) Close() {
+	d.unlock()
+}
+
+// removeFile removes a regular file, missing files and other kinds of files
+// are left alone
+func removeFile(path string) error {
+	info, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return nil
+	}
+	return os.Remove(path)
+}
+
+// writeFileSync writes data to file and flushes it to disk
+func writeFileSync(path string, data []byte) error {
+	return writeFileStream(path, func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	})
+}
+
+// writeFileStream calls write with buffered writer of the file and flushes
+// the file to disk
+func writeFileStream(path string, write func(w io.Writer) error) error {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return err
+	}
+	buf := bufio.NewWriterSize(file, dumpBufferSize)
+	if err := write(buf); err != nil {
+		file.Close()
+		return err
+	}
+	if err := buf.Flush(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// syncDir flushes directory entries to disk
+func syncDir(path string) error {
+	dir, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	if err := dir.Sync(); err != nil {
+		dir.Close()
+		return err
+	}
+	return dir.Close()
+}
@@ -0,0 +1,162 @@
+package wallet
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// manifestFile describes payment chunks written by HistoryToFilesAs
+const manifestFile = "payments.manifest.json"
+
+// paymentExtensions are extensions of payment files in every format
+var paymentExtensions = map[Format]string{
+	FormatDump: ".dump",
+	FormatJSON: ".jsonl",
+	FormatCSV:  ".csv",
+}
+
+// chunkManifest lists payment chunks in order
+type chunkManifest struct {
+	Format  Format  `json:"format"`
+	Records int     `json:"records"`
+	Chunks  []chunk `json:"chunks"`
+}
+
+type chunk struct {
+	File    string `json:"file"`
+	Records int    `json:"records"`
+	SHA256  string `json:"sha256"`
+}
+
+// writeManifest describes chunk files of dir in the manifest
+func writeManifest(dir string, format Format, files []string, records []int) error {
+	manifest := chunkManifest{Format: format}
+	for i, file := range files {
+		sum, err := fileSum(filepath.Join(dir, file))
+		if err != nil {
+			return err
+		}
+		manifest.Records += records[i]
+		manifest.Chunks = append(manifest.Chunks, chunk{File: file, Records: records[i], SHA256: sum})
+	}
+	return writeJSON(dir, manifestFile, manifest)
+}
+
+// removeChunks removes payment chunks with the extension left in dir by an
+// earlier export except the first keep chunks, so stale chunks aren't
+// imported with newer payments
+func removeChunks(dir string, extension string, keep int) error {
+	for _, number := range chunkNumbers(dir, extension) {
+		if number <= keep {
+			continue
+		}
+		if err := removeFile(filepath.Join(dir, fmt.Sprintf("payments%v%v", number, extension))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// chunkNumbers returns sorted numbers of payment chunks with the extension
+// found in dir
+func chunkNumbers(dir string, extension string) []int {
+	paths, _ := filepath.Glob(filepath.Join(dir, "payments*"+extension))
+	var numbers []int
+	for _, path := range paths {
+		name := filepath.Base(path)
+		number, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(name, "payments"), extension))
+		if err != nil || number <= 0 {
+			continue
+		}
+		numbers = append(numbers, number)
+	}
+	sort.Ints(numbers)
+	return numbers
+}
+
+// paymentFiles returns paths of payment files of export in the format: the
+// payments file of the current generation followed by payment history
+// written by HistoryToFilesAs
+func paymentFiles(export *exportDir, format Format) ([]string, error) {
+	var files []string
+	if export.generation != export.path {
+		files = append(files, filepath.Join(export.generation, "payments"+paymentExtensions[format]))
+	}
+	history, err := historyFiles(export.path, format)
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range history {
+		files = append(files, filepath.Join(export.path, file))
+	}
+	return files, nil
+}
+
+// historyFiles returns names of payment history files of dir in the format
+// in order. The manifest decides: when it lists chunks of the format, they
+// are checked against it and nothing else is read. Otherwise the single
+// payments file is read, and without manifest and single file payments1,
+// payments2 and so on are found by their numbers. Missing chunk fails with
+// ErrMissingChunk.
+func historyFiles(dir string, format Format) ([]string, error) {
+	extension := paymentExtensions[format]
+	manifest := chunkManifest{}
+	if err := readJSON(filepath.Join(dir, manifestFile), &manifest); err != nil {
+		return nil, err
+	}
+	if manifest.Format == format {
+		files := make([]string, len(manifest.Chunks))
+		for i, chunk := range manifest.Chunks {
+			sum, err := fileSum(filepath.Join(dir, chunk.File))
+			if os.IsNotExist(err) {
+				return nil, fmt.Errorf("%w: %v", ErrMissingChunk, chunk.File)
+			}
+			if err != nil {
+				return nil, err
+			}
+			if sum != chunk.SHA256 {
+				return nil, fmt.Errorf("%w: %v", ErrCorruptedDump, chunk.File)
+			}
+			files[i] = chunk.File
+		}
+		return files, nil
+	}
+
+	single := "payments" + extension
+	if _, err := os.Stat(filepath.Join(dir, single)); err == nil {
+		return []string{single}, nil
+	}
+	if manifest.Format != "" {
+		return nil, nil
+	}
+	numbers := chunkNumbers(dir, extension)
+	files := make([]string, len(numbers))
+	for i, number := range numbers {
+		if number != i+1 {
+			return nil, fmt.Errorf("%w: payments%v%v", ErrMissingChunk, i+1, extension)
+		}
+		files[i] = fmt.Sprintf("payments%v%v", number, extension)
+	}
+	return files, nil
+}
+
+// fileSum returns hex SHA-256 of file contents
+func fileSum(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
@@ -0,0 +1,24 @@
+package wallet
+
+import (
+	"context"
+	"errors"
+)
+
+// checkEvery is number of records long loops process between checks of
+// their context
+const checkEvery = 1024
+
+// interrupted returns error of ctx when it is done. Loops pass number of
+// processed records n, ctx is checked every checkEvery records only.
+func interrupted(ctx context.Context, n int) error {
+	if n%checkEvery != 0 {
+		return nil
+	}
+	return ctx.Err()
+}
+
+// isContextError tells whether err is returned by done context
+func isContextError(err error) bool {
+	return errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)
+}
@@ -0,0 +1,388 @@
+package wallet
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/ilhom0258/wallet/pkg/ledger"
+	"github.com/ilhom0258/wallet/pkg/types"
+)
+
+// Header rows of CSV files
+var (
+	accountsHeader    = []string{"id", "phone", "balance"}
+	paymentsHeader    = []string{"id", "account_id", "amount", "category", "status", "linked_id", "created", "updated"}
+	favoritesHeader   = []string{"id", "account_id", "name", "amount", "category"}
+	idempotencyHeader = []string{"key", "request", "payment_id"}
+	ledgerHeader      = []string{"id", "kind", "payment_id", "at", "account", "amount"}
+)
+
+func (s *Service) exportCSV(ctx context.Context, dir string) error {
+	s.mu.RLock()
+	accounts := s.snapshotAccountsLocked()
+	payments := s.snapshotPaymentsLocked()
+	favorites := s.snapshotFavoritesLocked()
+	keys := s.snapshotIdempotencyRecordsLocked()
+	entries := s.snapshotEntriesLocked()
+	s.mu.RUnlock()
+
+	return exportAtomically(ctx, dir, csvFiles, func(dir string) error {
+		if len(accounts) != 0 {
+			rows := make([][]string, len(accounts))
+			for i, account := range accounts {
+				rows[i] = []string{
+					strconv.FormatInt(account.ID, 10),
+					string(account.Phone),
+					strconv.FormatInt(int64(account.Balance), 10),
+				}
+			}
+			if err := writeCSV(dir, "accounts.csv", accountsHeader, rows); err != nil {
+				return err
+			}
+		}
+		if len(payments) != 0 {
+			path, err := pathMaker(dir, "payments.csv")
+			if err != nil {
+				return err
+			}
+			if err := exportPaymentsCSV(ctx, payments, path); err != nil {
+				return err
+			}
+		}
+		if len(favorites) != 0 {
+			rows := make([][]string, len(favorites))
+			for i, favorite := range favorites {
+				rows[i] = []string{
+					favorite.ID,
+					strconv.FormatInt(favorite.AccountID, 10),
+					favorite.Name,
+					strconv.FormatInt(int64(favorite.Amount), 10),
+					string(favorite.Category),
+				}
+			}
+			if err := writeCSV(dir, "favorites.csv", favoritesHeader, rows); err != nil {
+				return err
+			}
+		}
+		if len(keys) != 0 {
+			rows := make([][]string, len(keys))
+			for i, record := range keys {
+				rows[i] = []string{record.Key, record.Request, record.PaymentID}
+			}
+			if err := writeCSV(dir, "idempotency.csv", idempotencyHeader, rows); err != nil {
+				return err
+			}
+		}
+		if len(entries) != 0 {
+			path, err := pathMaker(dir, "ledger.csv")
+			if err != nil {
+				return err
+			}
+			if err := exportEntriesCSV(ctx, entries, path); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *Service) importCSV(ctx context.Context, dir string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	export, err := openExportDir(dir)
+	if err != nil {
+		return err
+	}
+	defer export.Close()
+
+	d := &dump{}
+	err = readCSV(ctx, filepath.Join(export.generation, "accounts.csv"), accountsHeader, func(row []string) error {
+		account, err := parseAccountRow(row)
+		if err != nil {
+			return err
+		}
+		d.accounts = append(d.accounts, account)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	files, err := paymentFiles(export, FormatCSV)
+	if err != nil {
+		return err
+	}
+	for _, path := range files {
+		err = readCSV(ctx, path, paymentsHeader, func(row []string) error {
+			payment, err := parsePaymentRow(row)
+			if err != nil {
+				return err
+			}
+			d.payments = append(d.payments, payment)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	err = readCSV(ctx, filepath.Join(export.generation, "favorites.csv"), favoritesHeader, func(row []string) error {
+		favorite, err := parseFavoriteRow(row)
+		if err != nil {
+			return err
+		}
+		d.favorites = append(d.favorites, favorite)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	err = readCSV(ctx, filepath.Join(export.generation, "idempotency.csv"), idempotencyHeader, func(row []string) error {
+		d.records = append(d.records, &IdempotencyRecord{Key: row[0], Request: row[1], PaymentID: row[2]})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	err = readCSV(ctx, filepath.Join(export.generation, "ledger.csv"), ledgerHeader, func(row []string) error {
+		leg, err := parseLegRow(row)
+		if err != nil {
+			return err
+		}
+		last := len(d.entries) - 1
+		if last < 0 || d.entries[last].ID != row[0] {
+			at, err := parseTime(row[3])
+			if err != nil {
+				return ErrInParsing
+			}
+			d.entries = append(d.entries, &ledger.Entry{ID: row[0], Kind: ledger.Kind(row[1]), PaymentID: row[2], At: at})
+			last++
+		}
+		d.entries[last].Legs = append(d.entries[last].Legs, leg)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, entry := range d.entries {
+		if entry.Validate() != nil {
+			return ErrInParsing
+		}
+	}
+	return s.importDump(ctx, d, ImportOptions{}, nil)
+}
+
+// exportPaymentsCSV writes payments to CSV file with header row one at a time
+func exportPaymentsCSV(ctx context.Context, payments []*types.Payment, path string) error {
+	return writeCSVStream(path, paymentsHeader, func(writer *csv.Writer) error {
+		for i, payment := range payments {
+			if err := interrupted(ctx, i); err != nil {
+				return err
+			}
+			err := writer.Write([]string{
+				payment.ID,
+				strconv.FormatInt(payment.AccountID, 10),
+				strconv.FormatInt(int64(payment.Amount), 10),
+				string(payment.Category),
+				string(payment.Status),
+				payment.LinkedID,
+				formatTime(payment.Created),
+				formatTime(payment.Updated),
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// exportEntriesCSV writes ledger entries to CSV file with header row, every
+// leg is a row which repeats ID, kind, payment ID and time of its entry
+func exportEntriesCSV(ctx context.Context, entries []*ledger.Entry, path string) error {
+	return writeCSVStream(path, ledgerHeader, func(writer *csv.Writer) error {
+		for i, entry := range entries {
+			if err := interrupted(ctx, i); err != nil {
+				return err
+			}
+			for _, leg := range entry.Legs {
+				err := writer.Write([]string{
+					entry.ID,
+					string(entry.Kind),
+					entry.PaymentID,
+					formatTime(entry.At),
+					leg.Account,
+					strconv.FormatInt(int64(leg.Amount), 10),
+				})
+				if err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+func writeCSV(dir string, fileName string, header []string, rows [][]string) error {
+	path, err := pathMaker(dir, fileName)
+	if err != nil {
+		return err
+	}
+	return writeCSVStream(path, header, func(writer *csv.Writer) error {
+		return writer.WriteAll(rows)
+	})
+}
+
+// writeCSVStream writes header row and calls write to add the rest
+func writeCSVStream(path string, header []string, write func(writer *csv.Writer) error) error {
+	err := writeFileStream(path, func(w io.Writer) error {
+		writer := csv.NewWriter(w)
+		if err := writer.Write(header); err != nil {
+			return err
+		}
+		if err := write(writer); err != nil {
+			return err
+		}
+		writer.Flush()
+		return writer.Error()
+	})
+	if isContextError(err) {
+		return err
+	}
+	if err != nil {
+		log.Print(err)
+		return ErrWorkingDirectoryNotFound
+	}
+	return nil
+}
+
+// readCSV calls read with every row of CSV file after its header one at a
+// time, missing file has no rows
+func readCSV(ctx context.Context, path string, header []string, read func(row []string) error) error {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if cerr := file.Close(); cerr != nil {
+			log.Print(cerr)
+		}
+	}()
+
+	reader := csv.NewReader(bufio.NewReaderSize(file, dumpBufferSize))
+	reader.FieldsPerRecord = len(header)
+	reader.ReuseRecord = true
+	first, err := reader.Read()
+	if err == io.EOF {
+		return nil
+	}
+	if err != nil || !equalRows(first, header) {
+		return ErrInParsing
+	}
+	for rows := 0; ; rows++ {
+		if err := interrupted(ctx, rows); err != nil {
+			return err
+		}
+		row, err := reader.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return ErrInParsing
+		}
+		if err := read(row); err != nil {
+			return err
+		}
+	}
+}
+
+func parseAccountRow(row []string) (*types.Account, error) {
+	id, err := strconv.ParseInt(row[0], 10, 64)
+	if err != nil {
+		return nil, ErrInParsing
+	}
+	balance, err := strconv.ParseInt(row[2], 10, 64)
+	if err != nil {
+		return nil, ErrInParsing
+	}
+	return &types.Account{
+		ID:      id,
+		Phone:   types.Phone(row[1]),
+		Balance: types.Money(balance),
+	}, nil
+}
+
+func parsePaymentRow(row []string) (*types.Payment, error) {
+	accountID, err := strconv.ParseInt(row[1], 10, 64)
+	if err != nil {
+		return nil, ErrInParsing
+	}
+	amount, err := strconv.ParseInt(row[2], 10, 64)
+	if err != nil {
+		return nil, ErrInParsing
+	}
+	created, err := parseTime(row[6])
+	if err != nil {
+		return nil, ErrInParsing
+	}
+	updated, err := parseTime(row[7])
+	if err != nil {
+		return nil, ErrInParsing
+	}
+	return &types.Payment{
+		ID:        row[0],
+		AccountID: accountID,
+		Amount:    types.Money(amount),
+		Category:  types.PaymentCategory(row[3]),
+		Status:    types.PaymentStatus(row[4]),
+		LinkedID:  row[5],
+		Created:   created,
+		Updated:   updated,
+	}, nil
+}
+
+func parseFavoriteRow(row []string) (*types.Favorite, error) {
+	accountID, err := strconv.ParseInt(row[1], 10, 64)
+	if err != nil {
+		return nil, ErrInParsing
+	}
+	amount, err := strconv.ParseInt(row[3], 10, 64)
+	if err != nil {
+		return nil, ErrInParsing
+	}
+	return &types.Favorite{
+		ID:        row[0],
+		AccountID: accountID,
+		Name:      row[2],
+		Amount:    types.Money(amount),
+		Category:  types.PaymentCategory(row[4]),
+	}, nil
+}
+
+func parseLegRow(row []string) (ledger.Leg, error) {
+	amount, err := strconv.ParseInt(row[5], 10, 64)
+	if err != nil {
+		return ledger.Leg{}, ErrInParsing
+	}
+	return ledger.Leg{Account: row[4], Amount: types.Money(amount)}, nil
+}
+
+func equalRows(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,256 @@
+package wallet
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// dumpVersion is version of .dump files written by Export. Version 1 files
+// have no header and are read as is.
+const dumpVersion = 2
+
+// dumpHeaderPrefix starts the first line of versioned .dump files:
+//
+//	#wallet-dump version=2 records=3 sha256=<hex digest of the body>
+//
+// The line is padded with spaces to dumpHeaderSize, so the header can be
+// written after the body is streamed.
+const dumpHeaderPrefix = "#wallet-dump "
+
+// dumpHeaderSize is length of the header line with the largest record count
+var dumpHeaderSize = len(dumpHeader(1<<63-1, make([]byte, sha256.Size)))
+
+// dumpBufferSize is size of buffers of dump readers and writers
+const dumpBufferSize = 64 * 1024
+
+func dumpHeader(records int, sum []byte) string {
+	return fmt.Sprintf("%sversion=%d records=%d sha256=%s",
+		dumpHeaderPrefix, dumpVersion, records, hex.EncodeToString(sum))
+}
+
+// dumpWriter writes .dump file one record at a time. The first error is
+// kept and returned by Close.
+type dumpWriter struct {
+	ctx     context.Context
+	file    *os.File
+	buf     *bufio.Writer
+	hash    hash.Hash
+	body    io.Writer
+	records int
+	err     error
+}
+
+// createDump creates .dump file with space for the header, writing stops
+// when ctx is done
+func createDump(ctx context.Context, path string) (*dumpWriter, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		log.Print(err)
+		return nil, ErrWorkingDirectoryNotFound
+	}
+	w := &dumpWriter{
+		ctx:  ctx,
+		file: file,
+		buf:  bufio.NewWriterSize(file, dumpBufferSize),
+		hash: sha256.New(),
+	}
+	w.body = io.MultiWriter(w.buf, w.hash)
+	_, w.err = w.buf.WriteString(strings.Repeat(" ", dumpHeaderSize) + "\n")
+	return w, nil
+}
+
+// Record writes fields as a single line
+func (w *dumpWriter) Record(fields ...string) {
+	if w.err != nil {
+		return
+	}
+	if w.err = interrupted(w.ctx, w.records); w.err != nil {
+		return
+	}
+	for i, field := range fields {
+		if i != 0 {
+			if _, w.err = io.WriteString(w.body, ";"); w.err != nil {
+				return
+			}
+		}
+		if _, w.err = io.WriteString(w.body, field); w.err != nil {
+			return
+		}
+	}
+	if _, w.err = io.WriteString(w.body, "\n"); w.err != nil {
+		return
+	}
+	w.records++
+}
+
+// Close writes the header, flushes the file to disk and closes it
+func (w *dumpWriter) Close() error {
+	if w.err == nil {
+		w.err = w.ctx.Err()
+	}
+	if w.err == nil {
+		w.err = w.buf.Flush()
+	}
+	if w.err == nil {
+		header := dumpHeader(w.records, w.hash.Sum(nil))
+		_, w.err = w.file.WriteAt([]byte(header+strings.Repeat(" ", dumpHeaderSize-len(header))), 0)
+	}
+	if w.err == nil {
+		w.err = w.file.Sync()
+	}
+	if err := w.file.Close(); w.err == nil {
+		w.err = err
+	}
+	if isContextError(w.err) {
+		return w.err
+	}
+	if w.err != nil {
+		log.Print(w.err)
+		return ErrWorkingDirectoryNotFound
+	}
+	return nil
+}
+
+// dumpReader reads .dump file one line at a time and checks the body against
+// the header when the end is reached. Files without header are read as is.
+type dumpReader struct {
+	ctx     context.Context
+	file    *os.File
+	buf     *bufio.Reader
+	hash    hash.Hash
+	header  map[string]string
+	line    int
+	text    string
+	records int
+	err     error
+}
+
+// openDump opens .dump file and reads its header, reading stops when ctx
+// is done
+func openDump(ctx context.Context, path string) (*dumpReader, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		log.Print(err)
+		return nil, ErrWorkingDirectoryNotFound
+	}
+	r := &dumpReader{
+		ctx:  ctx,
+		file: file,
+		buf:  bufio.NewReaderSize(file, dumpBufferSize),
+		hash: sha256.New(),
+	}
+	if err := r.readHeader(); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *dumpReader) readHeader() error {
+	prefix, err := r.buf.Peek(len(dumpHeaderPrefix))
+	if len(prefix) != 0 && strings.TrimLeft(string(prefix), " ") == "" {
+		// The header is written over spaces after the body, so the file
+		// wasn't closed
+		return ErrCorruptedDump
+	}
+	if err != nil || string(prefix) != dumpHeaderPrefix {
+		return nil
+	}
+	line, err := r.buf.ReadString('\n')
+	if err != nil {
+		return ErrCorruptedDump
+	}
+	r.line++
+	r.header = map[string]string{}
+	for _, field := range strings.Fields(line[len(dumpHeaderPrefix):]) {
+		parts := strings.SplitN(field, "=", 2)
+		if len(parts) != 2 {
+			return ErrCorruptedDump
+		}
+		r.header[parts[0]] = parts[1]
+	}
+	version, err := strconv.Atoi(r.header["version"])
+	if err != nil {
+		return ErrCorruptedDump
+	}
+	if version != dumpVersion {
+		return fmt.Errorf("%w: version %d", ErrUnsupportedDumpVersion, version)
+	}
+	return nil
+}
+
+// Next reads the next line, it returns false at the end of file or on error
+func (r *dumpReader) Next() bool {
+	if r.err != nil {
+		return false
+	}
+	if r.err = interrupted(r.ctx, r.line); r.err != nil {
+		return false
+	}
+	line, err := r.buf.ReadString('\n')
+	if len(line) != 0 {
+		r.hash.Write([]byte(line))
+		r.line++
+		r.text = strings.TrimSuffix(line, "\n")
+		if len(r.text) != len(line) {
+			r.records++
+		}
+	}
+	if err == io.EOF {
+		r.err = r.verify()
+		return len(line) != 0 && r.err == io.EOF
+	}
+	if err != nil {
+		r.err = err
+		return false
+	}
+	return true
+}
+
+// Text returns the current line without line break
+func (r *dumpReader) Text() string {
+	return r.text
+}
+
+// Line returns 1-based number of the current line in the file
+func (r *dumpReader) Line() int {
+	return r.line
+}
+
+// Err returns error which stopped Next, it is nil when the whole file is
+// read and matches its header
+func (r *dumpReader) Err() error {
+	if r.err == io.EOF {
+		return nil
+	}
+	return r.err
+}
+
+// Close closes the file
+func (r *dumpReader) Close() error {
+	return r.file.Close()
+}
+
+// verify checks the body against the header, io.EOF means it matches
+func (r *dumpReader) verify() error {
+	if r.header == nil {
+		return io.EOF
+	}
+	records, err := strconv.Atoi(r.header["records"])
+	if err != nil || records != r.records {
+		return ErrCorruptedDump
+	}
+	if r.header["sha256"] != hex.EncodeToString(r.hash.Sum(nil)) {
+		return ErrCorruptedDump
+	}
+	return io.EOF
+}
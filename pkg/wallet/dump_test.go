@@ -0,0 +1,165 @@
+package wallet
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ilhom0258/wallet/pkg/types"
+)
+
+func TestDumpWriter_longLines(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "favorites.dump")
+	name := strings.Repeat("n", 3*dumpBufferSize)
+	w, err := createDump(context.Background(), path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Record("f1", "1", name, "100", "auto")
+	w.Record("f2", "1", "home", "200", "auto")
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := openDump(context.Background(), path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	var lines []string
+	for r.Next() {
+		lines = append(lines, r.Text())
+	}
+	if err := r.Err(); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"f1;1;" + name + ";100;auto", "f2;1;home;200;auto"}
+	if len(lines) != len(want) || lines[0] != want[0] || lines[1] != want[1] {
+		t.Errorf("read %v lines, want %v", len(lines), len(want))
+	}
+	if r.Line() != 3 {
+		t.Errorf("last line = %v, want 3", r.Line())
+	}
+}
+
+func TestDumpReader_truncated(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "payments.dump")
+	if err := exportPayments(context.Background(), benchmarkPayments(10), path); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, data[:len(data)-10], 0666); err != nil {
+		t.Fatal(err)
+	}
+	r, err := openDump(context.Background(), path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	for r.Next() {
+	}
+	if err := r.Err(); err != ErrCorruptedDump {
+		t.Errorf("Err() = %v, want %v", err, ErrCorruptedDump)
+	}
+}
+
+func TestDumpReader_unclosed(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "payments.dump")
+	w, err := createDump(context.Background(), path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, payment := range benchmarkPayments(5000) {
+		w.Record(payment.ID, "1", "100", "auto", "OK")
+	}
+	// Flush part of the body without the header, as a crash before Close does
+	if err := w.buf.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	defer w.file.Close()
+
+	if _, err := openDump(context.Background(), path); err != ErrCorruptedDump {
+		t.Errorf("openDump() error = %v, want %v", err, ErrCorruptedDump)
+	}
+	report, err := newTestService().ImportWithReport(filepath.Dir(path), ImportStrict)
+	if err != ErrCorruptedDump {
+		t.Errorf("ImportWithReport() error = %v, want %v", err, ErrCorruptedDump)
+	}
+	if report.Accepted() != 0 {
+		t.Errorf("accepted %v lines of unclosed dump", report.Accepted())
+	}
+}
+
+// Export and import of payments take time linear in their number and make
+// the same allocations per payment, only I/O buffers stay of fixed size.
+// Import keeps every read payment, so its memory grows with the file.
+
+func BenchmarkExportPayments(b *testing.B) {
+	for _, count := range []int{1_000, 10_000, 100_000} {
+		payments := benchmarkPayments(count)
+		path := filepath.Join(b.TempDir(), "payments.dump")
+		b.Run(fmt.Sprint(count), func(b *testing.B) {
+			b.ReportAllocs()
+			start := time.Now()
+			for i := 0; i < b.N; i++ {
+				if err := exportPayments(context.Background(), payments, path); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(time.Since(start).Nanoseconds())/float64(b.N*count), "ns/payment")
+		})
+	}
+}
+
+func BenchmarkImportPayments(b *testing.B) {
+	for _, count := range []int{1_000, 10_000, 100_000} {
+		dir := b.TempDir()
+		if err := exportPayments(context.Background(), benchmarkPayments(count), filepath.Join(dir, "payments.dump")); err != nil {
+			b.Fatal(err)
+		}
+		export, err := openExportDir(dir)
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.Run(fmt.Sprint(count), func(b *testing.B) {
+			b.ReportAllocs()
+			s := &Service{}
+			start := time.Now()
+			for i := 0; i < b.N; i++ {
+				report := &ImportReport{}
+				if _, err := s.readDumps(context.Background(), export, report); err != nil {
+					b.Fatal(err)
+				}
+				if report.Accepted() != count {
+					b.Fatalf("read %v payments, want %v", report.Accepted(), count)
+				}
+			}
+			b.ReportMetric(float64(time.Since(start).Nanoseconds())/float64(b.N*count), "ns/payment")
+		})
+		export.Close()
+	}
+}
+
+func benchmarkPayments(count int) []*types.Payment {
+	created := time.Date(2020, 9, 1, 10, 0, 0, 0, time.UTC)
+	payments := make([]*types.Payment, count)
+	for i := range payments {
+		payments[i] = &types.Payment{
+			ID:        fmt.Sprintf("payment-%v", i),
+			AccountID: int64(i%100 + 1),
+			Amount:    types.Money(i%1000 + 1),
+			Category:  "auto",
+			Status:    types.PaymentStatusOk,
+			Created:   created.Add(time.Duration(i) * time.Second),
+			Updated:   created.Add(time.Duration(i) * time.Second),
+		}
+	}
+	return payments
+}
@@ -0,0 +1,92 @@
+package wallet
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"log"
+	"os"
+)
+
+// FileRepository keeps records in memory and journals every Save to a file,
+// so data survives restarts of the service. Each Save is written as a single
+// JSON line and synced to disk before it becomes visible.
+type FileRepository struct {
+	*MemoryRepository
+	file *os.File
+	size int64
+}
+
+// OpenFileRepository opens journal at path, creating it if needed, and
+// restores all records saved before
+func OpenFileRepository(path string) (*FileRepository, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return nil, err
+	}
+	repo := &FileRepository{
+		MemoryRepository: NewMemoryRepository(),
+		file:             file,
+	}
+	if err := repo.replay(); err != nil {
+		if cerr := file.Close(); cerr != nil {
+			log.Print(cerr)
+		}
+		return nil, err
+	}
+	return repo, nil
+}
+
+// Save journals changes and applies them in memory
+func (r *FileRepository) Save(changes Changes) error {
+	data, err := json.Marshal(changes)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+	if _, err := r.file.WriteAt(data, r.size); err != nil {
+		r.rollback()
+		return err
+	}
+	if err := r.file.Sync(); err != nil {
+		r.rollback()
+		return err
+	}
+	r.size += int64(len(data))
+	return r.MemoryRepository.Save(changes)
+}
+
+// Close closes journal file
+func (r *FileRepository) Close() error {
+	return r.file.Close()
+}
+
+// replay applies journaled changes, a torn last line left by a crash is dropped
+func (r *FileRepository) replay() error {
+	reader := bufio.NewReader(r.file)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		var changes Changes
+		if err := json.Unmarshal(line, &changes); err != nil {
+			return ErrCorruptedJournal
+		}
+		if err := r.MemoryRepository.Save(changes); err != nil {
+			return err
+		}
+		r.size += int64(len(line))
+	}
+	return r.file.Truncate(r.size)
+}
+
+// rollback cuts partially written line
+func (r *FileRepository) rollback() {
+	if err := r.file.Truncate(r.size); err != nil {
+		log.Print(err)
+	}
+}
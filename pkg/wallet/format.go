@@ -0,0 +1,385 @@
+package wallet
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/ilhom0258/wallet/pkg/ledger"
+	"github.com/ilhom0258/wallet/pkg/types"
+)
+
+// Format is encoding of files written by ExportAs and read by ImportAs
+type Format string
+
+const (
+	// FormatDump is semicolon delimited accounts.dump, payments.dump,
+	// favorites.dump, idempotency.dump and ledger.dump files used by Export
+	// and Import
+	FormatDump Format = "dump"
+	// FormatJSON is accounts.json, favorites.json and idempotency.json arrays
+	// and payments.jsonl and ledger.jsonl with one record per line
+	FormatJSON Format = "json"
+	// FormatCSV is RFC 4180 accounts.csv, payments.csv, favorites.csv,
+	// idempotency.csv and ledger.csv files with header rows, ledger.csv has
+	// a row for every leg of an entry
+	FormatCSV Format = "csv"
+)
+
+// Files written by Export and ExportAs in every format
+var (
+	dumpFiles = []string{"accounts.dump", "payments.dump", "favorites.dump", "idempotency.dump", "ledger.dump"}
+	jsonFiles = []string{"accounts.json", "payments.jsonl", "favorites.json", "idempotency.json", "ledger.jsonl"}
+	csvFiles  = []string{"accounts.csv", "payments.csv", "favorites.csv", "idempotency.csv", "ledger.csv"}
+)
+
+// ExportAs exports data to dir in the given format
+func (s *Service) ExportAs(dir string, format Format) error {
+	return s.ExportAsContext(context.Background(), dir, format)
+}
+
+// ExportAsContext exports data like ExportAs and stops when ctx is done, dir
+// isn't changed then
+func (s *Service) ExportAsContext(ctx context.Context, dir string, format Format) error {
+	switch format {
+	case FormatDump:
+		return s.ExportContext(ctx, dir)
+	case FormatJSON:
+		return s.exportJSON(ctx, dir)
+	case FormatCSV:
+		return s.exportCSV(ctx, dir)
+	default:
+		return ErrUnknownFormat
+	}
+}
+
+// ImportAs imports data from dir in the given format. Records which are
+// already in service are skipped like in Import. Payment chunks written by
+// HistoryToFilesAs in the format are imported in order of their manifest.
+func (s *Service) ImportAs(dir string, format Format) error {
+	return s.ImportAsContext(context.Background(), dir, format)
+}
+
+// ImportAsContext imports data like ImportAs and stops when ctx is done,
+// nothing is saved then
+func (s *Service) ImportAsContext(ctx context.Context, dir string, format Format) error {
+	switch format {
+	case FormatDump:
+		return s.ImportContext(ctx, dir)
+	case FormatJSON:
+		return s.importJSON(ctx, dir)
+	case FormatCSV:
+		return s.importCSV(ctx, dir)
+	default:
+		return ErrUnknownFormat
+	}
+}
+
+// HistoryToFilesAs exports payments into files of the given format. Up to
+// records payments go to a single payments file, more are split into
+// payments1, payments2 and so on with records payments in each, which are
+// listed in payments.manifest.json for Import. Payment files of the format
+// left by an earlier export which the new files don't replace are removed.
+func (s *Service) HistoryToFilesAs(payments []types.Payment, dir string, records int, format Format) error {
+	return s.HistoryToFilesAsContext(context.Background(), payments, dir, records, format)
+}
+
+// HistoryToFilesAsContext exports payments like HistoryToFilesAs and stops
+// when ctx is done, dir isn't changed then. Files are written aside and
+// renamed into dir, the manifest last.
+func (s *Service) HistoryToFilesAsContext(ctx context.Context, payments []types.Payment, dir string, records int, format Format) error {
+	var export func(ctx context.Context, payments []*types.Payment, path string) error
+	switch format {
+	case FormatDump:
+		export = exportPayments
+	case FormatJSON:
+		export = exportPaymentLines
+	case FormatCSV:
+		export = exportPaymentsCSV
+	default:
+		return ErrUnknownFormat
+	}
+	extension := paymentExtensions[format]
+
+	if len(payments) == 0 {
+		return nil
+	}
+	pmnts := make([]*types.Payment, len(payments))
+	for i := range payments {
+		pmnts[i] = &payments[i]
+	}
+	if records <= 0 || len(pmnts) <= records {
+		file := "payments" + extension
+		return writeAside(ctx, dir, func(staging string) ([]string, error) {
+			return []string{file}, export(ctx, pmnts, filepath.Join(staging, file))
+		}, func(path string) error {
+			if err := removeFile(filepath.Join(path, manifestFile)); err != nil {
+				return err
+			}
+			return removeChunks(path, extension, 0)
+		})
+	}
+	var files []string
+	return writeAside(ctx, dir, func(staging string) ([]string, error) {
+		var counts []int
+		for part := 0; part*records < len(pmnts); part++ {
+			end := (part + 1) * records
+			if end > len(pmnts) {
+				end = len(pmnts)
+			}
+			file := fmt.Sprintf("payments%v%v", part+1, extension)
+			if err := export(ctx, pmnts[part*records:end], filepath.Join(staging, file)); err != nil {
+				return nil, err
+			}
+			files = append(files, file)
+			counts = append(counts, end-part*records)
+		}
+		if err := writeManifest(staging, format, files, counts); err != nil {
+			return nil, err
+		}
+		return append(files, manifestFile), nil
+	}, func(path string) error {
+		if err := removeFile(filepath.Join(path, "payments"+extension)); err != nil {
+			return err
+		}
+		return removeChunks(path, extension, len(files))
+	})
+}
+
+func (s *Service) exportJSON(ctx context.Context, dir string) error {
+	s.mu.RLock()
+	accounts := s.snapshotAccountsLocked()
+	payments := s.snapshotPaymentsLocked()
+	favorites := s.snapshotFavoritesLocked()
+	keys := s.snapshotIdempotencyRecordsLocked()
+	entries := s.snapshotEntriesLocked()
+	s.mu.RUnlock()
+
+	return exportAtomically(ctx, dir, jsonFiles, func(dir string) error {
+		if len(accounts) != 0 {
+			if err := writeJSON(dir, "accounts.json", accounts); err != nil {
+				return err
+			}
+		}
+		if len(payments) != 0 {
+			path, err := pathMaker(dir, "payments.jsonl")
+			if err != nil {
+				return err
+			}
+			if err := exportPaymentLines(ctx, payments, path); err != nil {
+				return err
+			}
+		}
+		if len(favorites) != 0 {
+			if err := writeJSON(dir, "favorites.json", favorites); err != nil {
+				return err
+			}
+		}
+		if len(keys) != 0 {
+			if err := writeJSON(dir, "idempotency.json", keys); err != nil {
+				return err
+			}
+		}
+		if len(entries) != 0 {
+			path, err := pathMaker(dir, "ledger.jsonl")
+			if err != nil {
+				return err
+			}
+			if err := exportEntryLines(ctx, entries, path); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *Service) importJSON(ctx context.Context, dir string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	export, err := openExportDir(dir)
+	if err != nil {
+		return err
+	}
+	defer export.Close()
+
+	d := &dump{}
+	if err := readJSON(filepath.Join(export.generation, "accounts.json"), &d.accounts); err != nil {
+		return err
+	}
+	files, err := paymentFiles(export, FormatJSON)
+	if err != nil {
+		return err
+	}
+	for _, path := range files {
+		payments, err := readPaymentLines(ctx, path)
+		if err != nil {
+			return err
+		}
+		d.payments = append(d.payments, payments...)
+	}
+	if err := readJSON(filepath.Join(export.generation, "favorites.json"), &d.favorites); err != nil {
+		return err
+	}
+	if err := readJSON(filepath.Join(export.generation, "idempotency.json"), &d.records); err != nil {
+		return err
+	}
+	if d.entries, err = readEntryLines(ctx, filepath.Join(export.generation, "ledger.jsonl")); err != nil {
+		return err
+	}
+	return s.importDump(ctx, d, ImportOptions{}, nil)
+}
+
+func writeJSON(dir string, fileName string, value interface{}) error {
+	path, err := pathMaker(dir, fileName)
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(value, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeFileSync(path, append(data, '\n')); err != nil {
+		log.Print(err)
+		return ErrWorkingDirectoryNotFound
+	}
+	return nil
+}
+
+// exportPaymentLines writes payments to JSON Lines file one at a time
+func exportPaymentLines(ctx context.Context, payments []*types.Payment, path string) error {
+	err := writeFileStream(path, func(w io.Writer) error {
+		encoder := json.NewEncoder(w)
+		for i, payment := range payments {
+			if err := interrupted(ctx, i); err != nil {
+				return err
+			}
+			if err := encoder.Encode(payment); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if isContextError(err) {
+		return err
+	}
+	if err != nil {
+		log.Print(err)
+		return ErrWorkingDirectoryNotFound
+	}
+	return nil
+}
+
+// readJSON decodes file into value, missing file leaves value unchanged
+func readJSON(path string, value interface{}) error {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, value); err != nil {
+		return ErrInParsing
+	}
+	return nil
+}
+
+// readPaymentLines decodes JSON Lines file with payments, missing file has no payments
+func readPaymentLines(ctx context.Context, path string) ([]*types.Payment, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if cerr := file.Close(); cerr != nil {
+			log.Print(cerr)
+		}
+	}()
+
+	var payments []*types.Payment
+	decoder := json.NewDecoder(bufio.NewReaderSize(file, dumpBufferSize))
+	for {
+		if err := interrupted(ctx, len(payments)); err != nil {
+			return nil, err
+		}
+		payment := &types.Payment{}
+		err := decoder.Decode(payment)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, ErrInParsing
+		}
+		payments = append(payments, payment)
+	}
+	return payments, nil
+}
+
+// exportEntryLines writes ledger entries to JSON Lines file one at a time
+func exportEntryLines(ctx context.Context, entries []*ledger.Entry, path string) error {
+	err := writeFileStream(path, func(w io.Writer) error {
+		encoder := json.NewEncoder(w)
+		for i, entry := range entries {
+			if err := interrupted(ctx, i); err != nil {
+				return err
+			}
+			if err := encoder.Encode(entry); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if isContextError(err) {
+		return err
+	}
+	if err != nil {
+		log.Print(err)
+		return ErrWorkingDirectoryNotFound
+	}
+	return nil
+}
+
+// readEntryLines decodes JSON Lines file with ledger entries, missing file
+// has no entries
+func readEntryLines(ctx context.Context, path string) ([]*ledger.Entry, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if cerr := file.Close(); cerr != nil {
+			log.Print(cerr)
+		}
+	}()
+
+	var entries []*ledger.Entry
+	decoder := json.NewDecoder(bufio.NewReaderSize(file, dumpBufferSize))
+	for {
+		if err := interrupted(ctx, len(entries)); err != nil {
+			return nil, err
+		}
+		entry := &ledger.Entry{}
+		err := decoder.Decode(entry)
+		if err == io.EOF {
+			break
+		}
+		if err != nil || entry.Validate() != nil {
+			return nil, ErrInParsing
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
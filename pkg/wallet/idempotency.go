@@ -0,0 +1,105 @@
+package wallet
+
+import (
+	"fmt"
+
+	"github.com/ilhom0258/wallet/pkg/types"
+)
+
+// IdempotencyRecord remembers request made with idempotency key and its result
+type IdempotencyRecord struct {
+	Key string `json:"key"`
+	// Request describes operation and its arguments
+	Request string `json:"request"`
+	// PaymentID is ID of the created payment, empty for deposits
+	PaymentID string `json:"payment_id,omitempty"`
+}
+
+// PayWithKey makes payment like Pay. Retried call with the same key returns
+// the payment made by the first call instead of paying again. Empty key
+// disables the check.
+func (s *Service) PayWithKey(key string, accountID int64, amount types.Money, category types.PaymentCategory) (*types.Payment, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	request := fmt.Sprintf("pay:%v:%v:%v", accountID, amount, category)
+	return s.idempotent(key, request, func() (*types.Payment, Changes, error) {
+		return s.pay(accountID, amount, category)
+	})
+}
+
+// DepositWithKey deposits money like Deposit, only once per key
+func (s *Service) DepositWithKey(key string, accountID int64, amount types.Money) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	request := fmt.Sprintf("deposit:%v:%v", accountID, amount)
+	_, err := s.idempotent(key, request, func() (*types.Payment, Changes, error) {
+		changes, err := s.deposit(accountID, amount)
+		return nil, changes, err
+	})
+	return err
+}
+
+// RepeatWithKey repeats payment like Repeat, only once per key
+func (s *Service) RepeatWithKey(key string, paymentID string) (*types.Payment, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	request := fmt.Sprintf("repeat:%v", paymentID)
+	return s.idempotent(key, request, func() (*types.Payment, Changes, error) {
+		return s.repeat(paymentID)
+	})
+}
+
+// PayFromFavoriteWithKey pays favorite like PayFromFavorite, only once per key
+func (s *Service) PayFromFavoriteWithKey(key string, favoriteID string) (*types.Payment, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	request := fmt.Sprintf("favorite:%v", favoriteID)
+	return s.idempotent(key, request, func() (*types.Payment, Changes, error) {
+		return s.payFromFavorite(favoriteID)
+	})
+}
+
+// idempotent runs operation and saves its changes together with the key.
+// If key is already saved the operation isn't run and the saved payment is
+// returned. Caller must hold the write lock.
+func (s *Service) idempotent(key string, request string, operation func() (*types.Payment, Changes, error)) (*types.Payment, error) {
+	if key != "" {
+		record, err := s.storage().IdempotencyRecord(key)
+		if err == nil {
+			if record.Request != request {
+				return nil, ErrIdempotencyKeyReused
+			}
+			if record.PaymentID == "" {
+				return nil, nil
+			}
+			payment := s.findPayment(record.PaymentID)
+			if payment == nil {
+				return nil, ErrPaymentNotFound
+			}
+			return copyPayment(payment), nil
+		}
+	}
+
+	payment, changes, err := operation()
+	if err != nil {
+		return nil, err
+	}
+	if key != "" {
+		record := &IdempotencyRecord{Key: key, Request: request}
+		if payment != nil {
+			record.PaymentID = payment.ID
+		}
+		changes.IdempotencyRecords = append(changes.IdempotencyRecords, record)
+	}
+	if err := s.storage().Save(changes); err != nil {
+		return nil, err
+	}
+	if payment == nil {
+		return nil, nil
+	}
+	return copyPayment(payment), nil
+}
@@ -0,0 +1,609 @@
+package wallet
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/ilhom0258/wallet/pkg/ledger"
+	"github.com/ilhom0258/wallet/pkg/types"
+)
+
+// ImportMode selects what ImportWithReport does with invalid lines
+type ImportMode int
+
+const (
+	// ImportStrict fails the whole import on the first invalid line, nothing is saved
+	ImportStrict ImportMode = iota
+	// ImportLenient skips invalid lines and imports the rest
+	ImportLenient
+)
+
+// MergePolicy decides what import does with a record which differs from the
+// stored record with the same ID
+type MergePolicy int
+
+const (
+	// MergeSkip keeps the stored record
+	MergeSkip MergePolicy = iota
+	// MergeOverwrite replaces the stored record with the imported one
+	MergeOverwrite
+	// MergeFail fails the import with ErrImportConflict, nothing is saved
+	MergeFail
+	// MergeKeepNewest keeps the payment which changed last. Accounts and
+	// favorites have no time, imported ones replace stored like in MergeOverwrite.
+	MergeKeepNewest
+)
+
+// ImportOptions configures ImportWithOptions. Zero value is strict import
+// which skips records already in service.
+type ImportOptions struct {
+	Mode      ImportMode
+	Accounts  MergePolicy
+	Payments  MergePolicy
+	Favorites MergePolicy
+}
+
+// ImportIssue describes line of a dump file which can't be imported
+type ImportIssue struct {
+	File string
+	// Line is 1-based line number in the file
+	Line int
+	// Field is name of the invalid field, empty when the whole line is invalid
+	Field  string
+	Reason string
+}
+
+func (i ImportIssue) String() string {
+	if i.Field == "" {
+		return fmt.Sprintf("%s:%d: %s", i.File, i.Line, i.Reason)
+	}
+	return fmt.Sprintf("%s:%d: %s: %s", i.File, i.Line, i.Field, i.Reason)
+}
+
+// FileReport counts lines of a dump file
+type FileReport struct {
+	File     string
+	Accepted int
+	Rejected int
+}
+
+// ImportReport describes result of ImportWithReport
+type ImportReport struct {
+	Files  []FileReport
+	Issues []ImportIssue
+	// Skipped lists valid records which weren't imported, like accounts
+	// which phone belongs to another account and their records
+	Skipped []ImportIssue
+}
+
+// skip adds skipped record to the report, nil report ignores it
+func (r *ImportReport) skip(file string, line int, format string, args ...interface{}) {
+	if r != nil {
+		r.Skipped = append(r.Skipped, ImportIssue{File: file, Line: line, Reason: fmt.Sprintf(format, args...)})
+	}
+}
+
+// Accepted returns number of valid lines in all files
+func (r *ImportReport) Accepted() int {
+	accepted := 0
+	for _, file := range r.Files {
+		accepted += file.Accepted
+	}
+	return accepted
+}
+
+// Rejected returns number of invalid lines in all files
+func (r *ImportReport) Rejected() int {
+	rejected := 0
+	for _, file := range r.Files {
+		rejected += file.Rejected
+	}
+	return rejected
+}
+
+// ImportWithReport imports .dump files from dir like Import and reports
+// every line which can't be parsed. In ImportStrict mode any invalid line
+// fails the import with error matching ErrInParsing and nothing is saved,
+// in ImportLenient mode such lines are skipped. Files which don't match their
+// header fail the import in both modes.
+func (s *Service) ImportWithReport(dir string, mode ImportMode) (*ImportReport, error) {
+	return s.ImportWithReportContext(context.Background(), dir, mode)
+}
+
+// ImportWithReportContext imports data like ImportWithReport and stops when
+// ctx is done, nothing is saved then
+func (s *Service) ImportWithReportContext(ctx context.Context, dir string, mode ImportMode) (*ImportReport, error) {
+	return s.ImportWithOptionsContext(ctx, dir, ImportOptions{Mode: mode})
+}
+
+// ImportWithOptions imports .dump files from dir like ImportWithReport and
+// resolves records which are already in service by merge policies of their
+// types. Records are matched by ID, accounts also by phone: account which
+// phone belongs to another stored account or to an earlier account of the
+// dump is skipped by MergeSkip and fails the import with ErrImportConflict
+// otherwise. Replaced payments only change status the way Confirm, Complete
+// and Reject do, with their transitions recorded and the refund of rejection
+// journaled, other changes of payments fail with ErrImportConflict.
+func (s *Service) ImportWithOptions(dir string, options ImportOptions) (*ImportReport, error) {
+	return s.ImportWithOptionsContext(context.Background(), dir, options)
+}
+
+// ImportWithOptionsContext imports data like ImportWithOptions and stops when
+// ctx is done, nothing is saved then
+func (s *Service) ImportWithOptionsContext(ctx context.Context, dir string, options ImportOptions) (*ImportReport, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	export, err := openExportDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	defer export.Close()
+	report := &ImportReport{}
+	d, err := s.readDumps(ctx, export, report)
+	if err != nil {
+		return report, err
+	}
+	if options.Mode == ImportStrict && len(report.Issues) != 0 {
+		return report, fmt.Errorf("%w: %v", ErrInParsing, report.Issues[0])
+	}
+	return report, s.importDump(ctx, d, options, report)
+}
+
+// ValidateImport checks .dump files in dir without changing the service and
+// returns every problem found: lines which can't be parsed, duplicate IDs and
+// phones, phones registered to other accounts, negative balances, unknown
+// payment statuses, payments and favorites of accounts which are neither in
+// the dumps nor in the service.
+func (s *Service) ValidateImport(dir string) ([]ImportIssue, error) {
+	return s.ValidateImportContext(context.Background(), dir)
+}
+
+// ValidateImportContext checks .dump files like ValidateImport and stops when
+// ctx is done
+func (s *Service) ValidateImportContext(ctx context.Context, dir string) ([]ImportIssue, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	export, err := openExportDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	defer export.Close()
+	report := &ImportReport{}
+	d, err := s.readDumps(ctx, export, report)
+	if err != nil {
+		return nil, err
+	}
+	issues := report.Issues
+	issue := func(file string, line int, field string, format string, args ...interface{}) {
+		issues = append(issues, ImportIssue{File: file, Line: line, Field: field, Reason: fmt.Sprintf(format, args...)})
+	}
+
+	accounts := map[int64]bool{}
+	phones := map[types.Phone]int64{}
+	for i, account := range d.accounts {
+		line := d.accountLines[i]
+		if accounts[account.ID] {
+			issue("accounts.dump", line, "id", "duplicate account %v", account.ID)
+		}
+		accounts[account.ID] = true
+		if id, ok := phones[account.Phone]; ok && id != account.ID {
+			issue("accounts.dump", line, "phone", "phone %v is used by account %v", account.Phone, id)
+		}
+		phones[account.Phone] = account.ID
+		if stored, err := s.storage().AccountByPhone(account.Phone); err == nil && stored.ID != account.ID {
+			issue("accounts.dump", line, "phone", "phone %v is registered to account %v", account.Phone, stored.ID)
+		}
+		if account.Balance < 0 {
+			issue("accounts.dump", line, "balance", "negative balance %v", account.Balance)
+		}
+	}
+	known := func(accountID int64) bool {
+		return accounts[accountID] || s.findAccount(accountID) != nil
+	}
+
+	payments := map[string]bool{}
+	for i, payment := range d.payments {
+		file, line := d.paymentFiles[i], d.paymentLines[i]
+		if payments[payment.ID] {
+			issue(file, line, "id", "duplicate payment %v", payment.ID)
+		}
+		payments[payment.ID] = true
+		if !known(payment.AccountID) {
+			issue(file, line, "account_id", "unknown account %v", payment.AccountID)
+		}
+		if !validStatus(payment.Status) {
+			issue(file, line, "status", "unknown status %q", payment.Status)
+		}
+	}
+
+	favorites := map[string]bool{}
+	for i, favorite := range d.favorites {
+		line := d.favoriteLines[i]
+		if favorites[favorite.ID] {
+			issue("favorites.dump", line, "id", "duplicate favorite %v", favorite.ID)
+		}
+		favorites[favorite.ID] = true
+		if !known(favorite.AccountID) {
+			issue("favorites.dump", line, "account_id", "unknown account %v", favorite.AccountID)
+		}
+	}
+	return issues, nil
+}
+
+// importDump saves records of d which aren't in service and resolves the
+// rest by merge policies of options in a single Save, which is skipped when
+// ctx is done. Records of accounts skipped for their phone are skipped too
+// and listed in report. Caller must hold the write lock.
+func (s *Service) importDump(ctx context.Context, d *dump, options ImportOptions, report *ImportReport) error {
+	var accounts []*types.Account
+	phones := map[types.Phone]int64{}
+	skipped := map[int64]bool{}
+	for i, account := range d.accounts {
+		stored := s.findAccount(account.ID)
+		if stored != nil && *stored == *account {
+			continue
+		}
+		owner, ok := phones[account.Phone]
+		if !ok {
+			if stored, err := s.storage().AccountByPhone(account.Phone); err == nil {
+				owner, ok = stored.ID, true
+			}
+		}
+		if ok && owner != account.ID {
+			if options.Accounts == MergeSkip {
+				if stored == nil {
+					skipped[account.ID] = true
+				}
+				report.skip(fileAt(i, "accounts.dump", d.accountLines), lineAt(i, d.accountLines),
+					"phone %v of account %v belongs to account %v", account.Phone, account.ID, owner)
+				continue
+			}
+			return fmt.Errorf("%w: phone %v of account %v belongs to account %v", ErrImportConflict, account.Phone, account.ID, owner)
+		}
+		if stored != nil {
+			replace, err := resolve(options.Accounts, true)
+			if err != nil {
+				return fmt.Errorf("%w: account %v", err, account.ID)
+			}
+			if !replace {
+				continue
+			}
+		}
+		accounts = append(accounts, account)
+		phones[account.Phone] = account.ID
+	}
+	refunds := make(map[string]*ledger.Entry)
+	for _, entry := range d.entries {
+		if entry.Kind == ledger.KindRefund {
+			refunds[entry.PaymentID] = entry
+		}
+	}
+	var payments []*types.Payment
+	var transitions []*types.PaymentTransition
+	var journaled []*ledger.Entry
+	var fresh []*types.Payment
+	skippedPayments := map[string]bool{}
+	for i, payment := range d.payments {
+		if skipped[payment.AccountID] {
+			skippedPayments[payment.ID] = true
+			file := ""
+			if i < len(d.paymentFiles) {
+				file = d.paymentFiles[i]
+			}
+			report.skip(file, lineAt(i, d.paymentLines), "payment %v of skipped account %v", payment.ID, payment.AccountID)
+			continue
+		}
+		if stored := s.findPayment(payment.ID); stored != nil {
+			if *stored == *payment {
+				continue
+			}
+			replace, err := resolve(options.Payments, changedAt(payment).After(changedAt(stored)))
+			if err != nil {
+				return fmt.Errorf("%w: payment %v", err, payment.ID)
+			}
+			if !replace {
+				continue
+			}
+			replayed, err := replay(stored, payment)
+			if err != nil {
+				return err
+			}
+			transitions = append(transitions, replayed...)
+			if payment.Status == types.PaymentStatusFail && stored.Status != types.PaymentStatusFail {
+				refund := refunds[payment.ID]
+				if refund == nil {
+					refund = ledger.Move(ledger.KindRefund, payment.ID, ledger.MerchantClearing, ledger.Wallet(payment.AccountID), payment.Amount, changedAt(payment))
+				}
+				journaled = append(journaled, refund)
+			}
+		} else {
+			fresh = append(fresh, payment)
+		}
+		payments = append(payments, payment)
+	}
+	entries := append(s.paymentEntries(fresh, payments, d.entries), d.entries...)
+	changes, err := s.loadAccounts(accounts, entries, journaled)
+	if err != nil {
+		return err
+	}
+	changes.Payments = payments
+	changes.Transitions = transitions
+
+	for i, favorite := range d.favorites {
+		if skipped[favorite.AccountID] {
+			report.skip(fileAt(i, "favorites.dump", d.favoriteLines), lineAt(i, d.favoriteLines),
+				"favorite %v of skipped account %v", favorite.ID, favorite.AccountID)
+			continue
+		}
+		if stored, err := s.storage().FavoriteByID(favorite.ID); err == nil {
+			if *stored == *favorite {
+				continue
+			}
+			replace, err := resolve(options.Favorites, true)
+			if err != nil {
+				return fmt.Errorf("%w: favorite %v", err, favorite.ID)
+			}
+			if !replace {
+				continue
+			}
+		}
+		changes.Favorites = append(changes.Favorites, favorite)
+	}
+
+	for _, record := range d.records {
+		if skippedPayments[record.PaymentID] {
+			report.skip("", 0, "key %v of skipped payment %v", record.Key, record.PaymentID)
+			continue
+		}
+		if _, err := s.storage().IdempotencyRecord(record.Key); err != nil {
+			changes.IdempotencyRecords = append(changes.IdempotencyRecords, record)
+		}
+	}
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := s.storage().Save(changes); err != nil {
+		return err
+	}
+	for _, account := range changes.Accounts {
+		if account.ID > s.nextAccountID {
+			s.nextAccountID = account.ID
+		}
+	}
+	return nil
+}
+
+// replay returns transitions which move stored payment to status of the
+// imported one at the time it changed. Payments keep their account, amount
+// and link, and only change status the way the state machine allows, so
+// refunds aren't repeated. Other changes fail with ErrImportConflict.
+func replay(stored *types.Payment, imported *types.Payment) ([]*types.PaymentTransition, error) {
+	if imported.AccountID != stored.AccountID || imported.Amount != stored.Amount || imported.LinkedID != stored.LinkedID {
+		return nil, fmt.Errorf("%w: payment %v changes account, amount or link", ErrImportConflict, stored.ID)
+	}
+	events, ok := eventsTo(stored.Status, imported.Status)
+	if !ok || (len(events) != 0 && stored.LinkedID != "") {
+		return nil, fmt.Errorf("%w: payment %v can't change from %v to %v", ErrImportConflict, stored.ID, stored.Status, imported.Status)
+	}
+	var transitions []*types.PaymentTransition
+	payment := stored
+	for _, event := range events {
+		var transition *types.PaymentTransition
+		var err error
+		payment, transition, err = transit(payment, event, changedAt(imported))
+		if err != nil {
+			return nil, err
+		}
+		transitions = append(transitions, transition)
+	}
+	return transitions, nil
+}
+
+// resolve tells whether imported record replaces the differing stored one,
+// newer reports that imported record changed later
+func resolve(policy MergePolicy, newer bool) (bool, error) {
+	switch policy {
+	case MergeOverwrite:
+		return true, nil
+	case MergeFail:
+		return false, ErrImportConflict
+	case MergeKeepNewest:
+		return newer, nil
+	default:
+		return false, nil
+	}
+}
+
+// changedAt returns time of the last change of the payment
+func changedAt(payment *types.Payment) time.Time {
+	if payment.Updated.IsZero() {
+		return payment.Created
+	}
+	return payment.Updated
+}
+
+// paymentEntries journals fresh payments which imported entries don't
+// mention, so dumps written without a ledger keep the payments on account
+// statements. A transfer is journaled once by its debit payment, the credit
+// one is looked up among payments and stored ones.
+func (s *Service) paymentEntries(fresh []*types.Payment, payments []*types.Payment, entries []*ledger.Entry) []*ledger.Entry {
+	mentioned := make(map[string]bool)
+	for _, entry := range entries {
+		mentioned[entry.PaymentID] = true
+	}
+	byID := make(map[string]*types.Payment)
+	for _, payment := range payments {
+		byID[payment.ID] = payment
+	}
+	var result []*ledger.Entry
+	for _, payment := range fresh {
+		if payment.Amount == 0 || mentioned[payment.ID] || mentioned[payment.LinkedID] {
+			continue
+		}
+		created, changed := payment.Created, changedAt(payment)
+		if created.IsZero() {
+			created = s.now()
+		}
+		if changed.IsZero() {
+			changed = created
+		}
+		wallet := ledger.Wallet(payment.AccountID)
+		switch {
+		case payment.LinkedID == "":
+			result = append(result, ledger.Move(ledger.KindPayment, payment.ID, wallet, ledger.MerchantClearing, payment.Amount, created))
+			if payment.Status == types.PaymentStatusFail {
+				result = append(result, ledger.Move(ledger.KindRefund, payment.ID, ledger.MerchantClearing, wallet, payment.Amount, changed))
+			}
+		case payment.Category == types.PaymentCategoryTransferOut:
+			credit := byID[payment.LinkedID]
+			if credit == nil {
+				credit = s.findPayment(payment.LinkedID)
+			}
+			if credit != nil {
+				result = append(result, ledger.Move(ledger.KindTransfer, payment.ID, wallet, ledger.Wallet(credit.AccountID), payment.Amount, created))
+			}
+		}
+	}
+	return result
+}
+
+// dump holds imported records, files and lines tell where in .dump files
+// they are
+type dump struct {
+	accounts      []*types.Account
+	accountLines  []int
+	payments      []*types.Payment
+	paymentFiles  []string
+	paymentLines  []int
+	favorites     []*types.Favorite
+	favoriteLines []int
+	records       []*IdempotencyRecord
+	entries       []*ledger.Entry
+}
+
+// fileAt returns name of file of the i-th record, files and lines are known
+// only for records read from .dump files
+func fileAt(i int, name string, lines []int) string {
+	if i < len(lines) {
+		return name
+	}
+	return ""
+}
+
+// lineAt returns line of the i-th record or 0 when it's unknown
+func lineAt(i int, lines []int) int {
+	if i < len(lines) {
+		return lines[i]
+	}
+	return 0
+}
+
+// readDumps reads all .dump files of export including payment chunks
+// written by HistoryToFiles, invalid lines are added to report
+func (s *Service) readDumps(ctx context.Context, export *exportDir, report *ImportReport) (*dump, error) {
+	d := &dump{}
+	err := s.readDumpFile(ctx, filepath.Join(export.generation, "accounts.dump"), report, func(line int, info []string) *ImportIssue {
+		account, issue := parseAccount(info)
+		if issue == nil {
+			d.accounts = append(d.accounts, account)
+			d.accountLines = append(d.accountLines, line)
+		}
+		return issue
+	})
+	if err != nil {
+		return nil, err
+	}
+	files, err := paymentFiles(export, FormatDump)
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range files {
+		file := filepath.Base(path)
+		err = s.readDumpFile(ctx, path, report, func(line int, info []string) *ImportIssue {
+			payment, issue := parsePayment(info)
+			if issue == nil {
+				d.payments = append(d.payments, payment)
+				d.paymentFiles = append(d.paymentFiles, file)
+				d.paymentLines = append(d.paymentLines, line)
+			}
+			return issue
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	err = s.readDumpFile(ctx, filepath.Join(export.generation, "favorites.dump"), report, func(line int, info []string) *ImportIssue {
+		favorite, issue := parseFavorite(info)
+		if issue == nil {
+			d.favorites = append(d.favorites, favorite)
+			d.favoriteLines = append(d.favoriteLines, line)
+		}
+		return issue
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = s.readDumpFile(ctx, filepath.Join(export.generation, "idempotency.dump"), report, func(line int, info []string) *ImportIssue {
+		record, issue := parseIdempotencyRecord(info)
+		if issue == nil {
+			d.records = append(d.records, record)
+		}
+		return issue
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = s.readDumpFile(ctx, filepath.Join(export.generation, "ledger.dump"), report, func(line int, info []string) *ImportIssue {
+		entry, issue := parseEntry(info)
+		if issue == nil {
+			d.entries = append(d.entries, entry)
+		}
+		return issue
+	})
+	if err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// readDumpFile calls parse with number and fields of every line of the file
+// and adds the file and its rejected lines to report. Missing file is skipped.
+func (s *Service) readDumpFile(ctx context.Context, path string, report *ImportReport, parse func(line int, info []string) *ImportIssue) error {
+	name := filepath.Base(path)
+	if !s.fileExist(path) {
+		return nil
+	}
+	r, err := openDump(ctx, path)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	file := FileReport{File: name}
+	for r.Next() {
+		item := r.Text()
+		if len(strings.Trim(item, " ")) == 0 {
+			continue
+		}
+		issue := parse(r.Line(), strings.Split(item, ";"))
+		if issue != nil {
+			issue.File = name
+			issue.Line = r.Line()
+			report.Issues = append(report.Issues, *issue)
+			file.Rejected++
+			continue
+		}
+		file.Accepted++
+	}
+	if err := r.Err(); err != nil {
+		return err
+	}
+	report.Files = append(report.Files, file)
+	return nil
+}
@@ -0,0 +1,253 @@
+package wallet
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/ilhom0258/wallet/pkg/ledger"
+	"github.com/ilhom0258/wallet/pkg/types"
+)
+
+// LedgerBalance returns balance of the account calculated from the ledger
+func (s *Service) LedgerBalance(accountID int64) (types.Money, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.findAccount(accountID) == nil {
+		return 0, ErrAccountNotFound
+	}
+	name := ledger.Wallet(accountID)
+	balance := types.Money(0)
+	for _, entry := range s.storage().Entries() {
+		balance += entry.Amount(name)
+	}
+	return balance, nil
+}
+
+// LedgerEntries returns all journal entries which changed balance of the account
+func (s *Service) LedgerEntries(accountID int64) ([]ledger.Entry, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.findAccount(accountID) == nil {
+		return nil, ErrAccountNotFound
+	}
+	name := ledger.Wallet(accountID)
+	entries := []ledger.Entry{}
+	for _, entry := range s.storage().Entries() {
+		if entry.Amount(name) != 0 {
+			entries = append(entries, entry.Copy())
+		}
+	}
+	return entries, nil
+}
+
+// VerifyLedger checks that every journal entry is balanced and balance of
+// every account is equal to its ledger balance
+func (s *Service) VerifyLedger() error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	entries := s.storage().Entries()
+	for _, entry := range entries {
+		if err := entry.Validate(); err != nil {
+			return fmt.Errorf("entry %v: %w", entry.ID, err)
+		}
+	}
+	balances := ledger.Balances(entries)
+	for _, account := range s.storage().Accounts() {
+		name := ledger.Wallet(account.ID)
+		if balances[name] != account.Balance {
+			return fmt.Errorf("%w: account %v balance %v, ledger %v",
+				ErrLedgerMismatch, account.ID, account.Balance, balances[name])
+		}
+		delete(balances, name)
+	}
+	for name := range balances {
+		if _, ok := ledger.WalletID(name); ok {
+			return fmt.Errorf("%w: ledger account %v has no wallet account", ErrLedgerMismatch, name)
+		}
+	}
+	return nil
+}
+
+// journal records entry in changes and applies it to balances of the given
+// accounts, balances are never changed apart from the ledger
+func (c *Changes) journal(entry *ledger.Entry, accounts ...*types.Account) error {
+	if err := entry.Validate(); err != nil {
+		return err
+	}
+	for _, account := range accounts {
+		account.Balance += entry.Amount(ledger.Wallet(account.ID))
+	}
+	c.Entries = append(c.Entries, entry)
+	return nil
+}
+
+// loadAccounts prepares changes which store imported accounts and ledger
+// entries which aren't stored yet. Entries are loaded only when every wallet
+// account they move money of is imported, journaled entries are always
+// posted and change stored accounts which aren't imported. Remaining
+// differences between stored and imported balances are journaled as
+// adjustments, those of new accounts open them before their first entry.
+// Caller must hold the write lock.
+func (s *Service) loadAccounts(accounts []*types.Account, entries []*ledger.Entry, journaled []*ledger.Entry) (Changes, error) {
+	changes := Changes{}
+	loaded := make(map[int64]bool)
+	for _, account := range accounts {
+		loaded[account.ID] = true
+	}
+	known := make(map[string]bool)
+	for _, entry := range s.storage().Entries() {
+		known[entry.ID] = true
+	}
+	moved := make(map[int64]types.Money)
+	first := make(map[int64]time.Time)
+	var touched []int64
+	for _, entry := range journaled {
+		if known[entry.ID] {
+			continue
+		}
+		if err := entry.Validate(); err != nil {
+			return Changes{}, fmt.Errorf("entry %v: %w", entry.ID, err)
+		}
+		for _, leg := range entry.Legs {
+			id, ok := ledger.WalletID(leg.Account)
+			if !ok {
+				continue
+			}
+			if _, seen := moved[id]; !seen && !loaded[id] {
+				touched = append(touched, id)
+			}
+			moved[id] += leg.Amount
+			first[id] = earliest(first[id], entry.At)
+		}
+		known[entry.ID] = true
+		changes.Entries = append(changes.Entries, entry)
+	}
+	for _, entry := range entries {
+		if known[entry.ID] || !movesOnly(entry, loaded) {
+			continue
+		}
+		if err := entry.Validate(); err != nil {
+			return Changes{}, fmt.Errorf("entry %v: %w", entry.ID, err)
+		}
+		for _, leg := range entry.Legs {
+			if id, ok := ledger.WalletID(leg.Account); ok {
+				moved[id] += leg.Amount
+				first[id] = earliest(first[id], entry.At)
+			}
+		}
+		known[entry.ID] = true
+		changes.Entries = append(changes.Entries, entry)
+	}
+
+	opening := Changes{}
+	balances := make(map[int64]types.Money)
+	for _, imported := range accounts {
+		balance, ok := balances[imported.ID]
+		stored := s.findAccount(imported.ID)
+		if !ok {
+			if stored != nil {
+				balance = stored.Balance
+			}
+			balance += moved[imported.ID]
+		}
+		account := copyAccount(imported)
+		account.Balance = balance
+		if diff := imported.Balance - balance; diff != 0 {
+			// balance of a new account is opened before its first entry
+			at, adjustments := s.now(), &changes
+			if stored == nil && !ok && !first[account.ID].IsZero() {
+				at, adjustments = earliest(at, first[account.ID]), &opening
+			}
+			entry := ledger.Move(ledger.KindAdjustment, "", ledger.OpeningBalance, ledger.Wallet(account.ID), diff, at)
+			if err := adjustments.journal(entry, account); err != nil {
+				return Changes{}, err
+			}
+		}
+		balances[account.ID] = account.Balance
+		changes.Accounts = append(changes.Accounts, account)
+	}
+	for _, id := range touched {
+		stored := s.findAccount(id)
+		if stored == nil {
+			return Changes{}, fmt.Errorf("%w: %v", ErrAccountNotFound, id)
+		}
+		account := copyAccount(stored)
+		account.Balance += moved[id]
+		changes.Accounts = append(changes.Accounts, account)
+	}
+	changes.Entries = append(opening.Entries, changes.Entries...)
+	return changes, nil
+}
+
+// earliest returns the earlier of at and other, zero at counts as unset
+func earliest(at, other time.Time) time.Time {
+	if at.IsZero() || other.Before(at) {
+		return other
+	}
+	return at
+}
+
+// movesOnly tells whether all wallet accounts of entry are in accounts
+func movesOnly(entry *ledger.Entry, accounts map[int64]bool) bool {
+	for _, leg := range entry.Legs {
+		if id, ok := ledger.WalletID(leg.Account); ok && !accounts[id] {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *Service) snapshotEntriesLocked() []*ledger.Entry {
+	stored := s.storage().Entries()
+	entries := make([]*ledger.Entry, len(stored))
+	for i, entry := range stored {
+		copied := entry.Copy()
+		entries[i] = &copied
+	}
+	return entries
+}
+
+// exportEntries writes entries to ledger.dump, a line holds ID, kind,
+// payment ID and time of entry followed by account and amount of its legs
+func exportEntries(ctx context.Context, entries []*ledger.Entry, path string) error {
+	w, err := createDump(ctx, path)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		fields := []string{entry.ID, string(entry.Kind), entry.PaymentID, formatTime(entry.At)}
+		for _, leg := range entry.Legs {
+			fields = append(fields, leg.Account, strconv.FormatInt(int64(leg.Amount), 10))
+		}
+		w.Record(fields...)
+	}
+	return w.Close()
+}
+
+// parseEntry parses fields of ledger.dump line
+func parseEntry(info []string) (*ledger.Entry, *ImportIssue) {
+	if len(info) < 8 || len(info)%2 != 0 {
+		return nil, &ImportIssue{Reason: fmt.Sprintf("got %v fields, want 4 and two for every leg", len(info))}
+	}
+	at, err := parseTime(info[3])
+	if err != nil {
+		return nil, &ImportIssue{Field: "at", Reason: fmt.Sprintf("invalid time %q", info[3])}
+	}
+	entry := &ledger.Entry{ID: info[0], Kind: ledger.Kind(info[1]), PaymentID: info[2], At: at}
+	for i := 4; i < len(info); i += 2 {
+		amount, err := strconv.ParseInt(info[i+1], 10, 64)
+		if err != nil {
+			return nil, invalidNumber("amount", info[i+1])
+		}
+		entry.Legs = append(entry.Legs, ledger.Leg{Account: info[i], Amount: types.Money(amount)})
+	}
+	if err := entry.Validate(); err != nil {
+		return nil, &ImportIssue{Field: "legs", Reason: err.Error()}
+	}
+	return entry, nil
+}
@@ -0,0 +1,143 @@
+package wallet
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/ilhom0258/wallet/pkg/types"
+)
+
+// paymentTransitions lists statuses which payment gets on every allowed event.
+// Payments start in PaymentStatusInProgress, PaymentStatusOk and
+// PaymentStatusFail are final.
+var paymentTransitions = map[types.PaymentStatus]map[types.PaymentEvent]types.PaymentStatus{
+	types.PaymentStatusInProgress: {
+		types.PaymentEventConfirm: types.PaymentStatusConfirmed,
+		types.PaymentEventReject:  types.PaymentStatusFail,
+	},
+	types.PaymentStatusConfirmed: {
+		types.PaymentEventComplete: types.PaymentStatusOk,
+		types.PaymentEventReject:   types.PaymentStatusFail,
+	},
+}
+
+// eventsTo returns the shortest sequence of events which moves payment from
+// status to target, ok is false when target can't be reached
+func eventsTo(status types.PaymentStatus, target types.PaymentStatus) (events []types.PaymentEvent, ok bool) {
+	if status == target {
+		return nil, true
+	}
+	for event, next := range paymentTransitions[status] {
+		if next == target {
+			return []types.PaymentEvent{event}, true
+		}
+	}
+	for event, next := range paymentTransitions[status] {
+		if rest, ok := eventsTo(next, target); ok && (events == nil || len(rest)+1 < len(events)) {
+			events = append([]types.PaymentEvent{event}, rest...)
+		}
+	}
+	return events, events != nil
+}
+
+// validStatus checks that payment can have the status
+func validStatus(status types.PaymentStatus) bool {
+	switch status {
+	case types.PaymentStatusInProgress, types.PaymentStatusConfirmed, types.PaymentStatusOk, types.PaymentStatusFail:
+		return true
+	}
+	return false
+}
+
+// TransitionError is returned when event isn't allowed in current status of the payment
+type TransitionError struct {
+	PaymentID string
+	Status    types.PaymentStatus
+	Event     types.PaymentEvent
+}
+
+func (e *TransitionError) Error() string {
+	return fmt.Sprintf("can't %s payment %s in status %s", strings.ToLower(string(e.Event)), e.PaymentID, e.Status)
+}
+
+// Is makes errors.Is(err, ErrInvalidTransition) true for every TransitionError
+func (e *TransitionError) Is(target error) bool {
+	return target == ErrInvalidTransition
+}
+
+// Confirm moves payment in progress to PaymentStatusConfirmed
+func (s *Service) Confirm(paymentID string) error {
+	return s.applyEvent(paymentID, types.PaymentEventConfirm)
+}
+
+// Complete moves confirmed payment to PaymentStatusOk
+func (s *Service) Complete(paymentID string) error {
+	return s.applyEvent(paymentID, types.PaymentEventComplete)
+}
+
+// PaymentHistory returns all status changes of the payment, oldest first
+func (s *Service) PaymentHistory(paymentID string) ([]types.PaymentTransition, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.findPayment(paymentID) == nil {
+		return nil, ErrPaymentNotFound
+	}
+	history := []types.PaymentTransition{}
+	for _, transition := range s.storage().PaymentTransitions(paymentID) {
+		history = append(history, *transition)
+	}
+	return history, nil
+}
+
+func (s *Service) applyEvent(paymentID string, event types.PaymentEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	payment := s.findPayment(paymentID)
+	if payment == nil {
+		return ErrPaymentNotFound
+	}
+	payment, transition, err := transit(payment, event, s.now())
+	if err != nil {
+		return err
+	}
+	return s.storage().Save(Changes{
+		Payments:    []*types.Payment{payment},
+		Transitions: []*types.PaymentTransition{transition},
+	})
+}
+
+// transit returns copy of the payment changed at the given time and record of the transition
+func transit(payment *types.Payment, event types.PaymentEvent, at time.Time) (*types.Payment, *types.PaymentTransition, error) {
+	status, ok := paymentTransitions[payment.Status][event]
+	if !ok {
+		return nil, nil, &TransitionError{
+			PaymentID: payment.ID,
+			Status:    payment.Status,
+			Event:     event,
+		}
+	}
+	transition := &types.PaymentTransition{
+		PaymentID: payment.ID,
+		Event:     event,
+		From:      payment.Status,
+		To:        status,
+		At:        at,
+	}
+	payment = copyPayment(payment)
+	payment.Status = status
+	payment.Updated = at
+	return payment, transition, nil
+}
+
+// created returns record about creation of the payment
+func created(payment *types.Payment) *types.PaymentTransition {
+	return &types.PaymentTransition{
+		PaymentID: payment.ID,
+		Event:     types.PaymentEventCreate,
+		To:        payment.Status,
+		At:        payment.Created,
+	}
+}
@@ -0,0 +1,256 @@
+package wallet
+
+import (
+	"encoding/base64"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ilhom0258/wallet/pkg/types"
+)
+
+// PaymentSort is field PaymentQuery sorts payments by. Payments with equal
+// fields are sorted by ID, so every order is total.
+type PaymentSort int
+
+const (
+	// SortByCreated sorts payments by time of creation
+	SortByCreated PaymentSort = iota
+	// SortByUpdated sorts payments by time of the last change
+	SortByUpdated
+	// SortByAmount sorts payments by amount
+	SortByAmount
+)
+
+// PaymentQuery selects a page of payments. It is built by chaining methods
+// of Service.QueryPayments and run by Fetch:
+//
+//	page, err := s.QueryPayments().Account(1).Status(types.PaymentStatusOk).
+//		SortBy(SortByAmount, true).Limit(20).Fetch()
+//
+// Filters are combined, zero value bounds leave ranges open. Query without
+// sorting returns payments oldest first.
+type PaymentQuery struct {
+	service    *Service
+	accountID  int64
+	categories []types.PaymentCategory
+	statuses   []types.PaymentStatus
+	minAmount  types.Money
+	maxAmount  types.Money
+	from       time.Time
+	to         time.Time
+	sort       PaymentSort
+	descending bool
+	offset     int
+	limit      int
+	cursor     string
+}
+
+// PaymentPage is result of PaymentQuery
+type PaymentPage struct {
+	Payments []types.Payment
+	// Total is number of payments matching the filters on all pages
+	Total int
+	// NextCursor continues the query after this page, it is empty on the last page
+	NextCursor string
+}
+
+// QueryPayments starts a query over all payments of the service
+func (s *Service) QueryPayments() *PaymentQuery {
+	return &PaymentQuery{service: s}
+}
+
+// Account selects payments of the account, Fetch fails with
+// ErrAccountNotFound for unknown accounts
+func (q *PaymentQuery) Account(accountID int64) *PaymentQuery {
+	q.accountID = accountID
+	return q
+}
+
+// Category selects payments of any of categories
+func (q *PaymentQuery) Category(categories ...types.PaymentCategory) *PaymentQuery {
+	q.categories = categories
+	return q
+}
+
+// Status selects payments in any of statuses
+func (q *PaymentQuery) Status(statuses ...types.PaymentStatus) *PaymentQuery {
+	q.statuses = statuses
+	return q
+}
+
+// Amount selects payments with amount in [min, max]
+func (q *PaymentQuery) Amount(min types.Money, max types.Money) *PaymentQuery {
+	q.minAmount = min
+	q.maxAmount = max
+	return q
+}
+
+// Created selects payments created in [from, to)
+func (q *PaymentQuery) Created(from time.Time, to time.Time) *PaymentQuery {
+	q.from = from
+	q.to = to
+	return q
+}
+
+// SortBy sorts payments by field, descending sorts the largest first
+func (q *PaymentQuery) SortBy(field PaymentSort, descending bool) *PaymentQuery {
+	q.sort = field
+	q.descending = descending
+	return q
+}
+
+// Offset skips the first n payments of the page
+func (q *PaymentQuery) Offset(n int) *PaymentQuery {
+	q.offset = n
+	return q
+}
+
+// Limit returns at most n payments, zero means no limit
+func (q *PaymentQuery) Limit(n int) *PaymentQuery {
+	q.limit = n
+	return q
+}
+
+// After continues the query after the page which returned cursor. The cursor
+// stays valid when payments are added or changed, offset is counted from it.
+func (q *PaymentQuery) After(cursor string) *PaymentQuery {
+	q.cursor = cursor
+	return q
+}
+
+// Fetch runs the query
+func (q *PaymentQuery) Fetch() (*PaymentPage, error) {
+	s := q.service
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	candidates := s.storage().Payments()
+	if q.accountID != 0 {
+		if s.findAccount(q.accountID) == nil {
+			return nil, ErrAccountNotFound
+		}
+		candidates = s.storage().PaymentsByAccount(q.accountID)
+	}
+	var matched []*types.Payment
+	for _, payment := range candidates {
+		if q.match(payment) {
+			matched = append(matched, payment)
+		}
+	}
+	sort.SliceStable(matched, func(i, j int) bool {
+		return q.before(q.key(matched[i]), matched[i].ID, q.key(matched[j]), matched[j].ID)
+	})
+
+	page := &PaymentPage{Total: len(matched), Payments: []types.Payment{}}
+	start := 0
+	if q.cursor != "" {
+		key, id, err := q.decodeCursor()
+		if err != nil {
+			return nil, err
+		}
+		start = sort.Search(len(matched), func(i int) bool {
+			return q.before(key, id, q.key(matched[i]), matched[i].ID)
+		})
+	}
+	if q.offset > 0 {
+		start += q.offset
+	}
+	if start > len(matched) {
+		start = len(matched)
+	}
+	end := len(matched)
+	if q.limit > 0 && start+q.limit < end {
+		end = start + q.limit
+	}
+	for _, payment := range matched[start:end] {
+		page.Payments = append(page.Payments, *payment)
+	}
+	if end < len(matched) && end > start {
+		last := matched[end-1]
+		page.NextCursor = q.encodeCursor(q.key(last), last.ID)
+	}
+	return page, nil
+}
+
+func (q *PaymentQuery) match(payment *types.Payment) bool {
+	if len(q.categories) != 0 && !containsCategory(q.categories, payment.Category) {
+		return false
+	}
+	if len(q.statuses) != 0 && !containsStatus(q.statuses, payment.Status) {
+		return false
+	}
+	if q.minAmount != 0 && payment.Amount < q.minAmount {
+		return false
+	}
+	if q.maxAmount != 0 && payment.Amount > q.maxAmount {
+		return false
+	}
+	return inRange(payment.Created, q.from, q.to)
+}
+
+// key returns value of the sort field of payment
+func (q *PaymentQuery) key(payment *types.Payment) int64 {
+	switch q.sort {
+	case SortByUpdated:
+		return changedAt(payment).UnixNano()
+	case SortByAmount:
+		return int64(payment.Amount)
+	default:
+		return payment.Created.UnixNano()
+	}
+}
+
+// before tells whether payment with key a and ID idA goes before payment
+// with key b and ID idB in order of the query
+func (q *PaymentQuery) before(a int64, idA string, b int64, idB string) bool {
+	if q.descending {
+		a, idA, b, idB = b, idB, a, idA
+	}
+	if a != b {
+		return a < b
+	}
+	return idA < idB
+}
+
+// encodeCursor returns cursor pointing after payment with key and ID
+func (q *PaymentQuery) encodeCursor(key int64, id string) string {
+	cursor := fmt.Sprintf("%d:%t:%d:%s", q.sort, q.descending, key, id)
+	return base64.RawURLEncoding.EncodeToString([]byte(cursor))
+}
+
+func (q *PaymentQuery) decodeCursor() (int64, string, error) {
+	data, err := base64.RawURLEncoding.DecodeString(q.cursor)
+	if err != nil {
+		return 0, "", ErrInvalidCursor
+	}
+	parts := strings.SplitN(string(data), ":", 4)
+	if len(parts) != 4 || parts[0] != strconv.Itoa(int(q.sort)) || parts[1] != strconv.FormatBool(q.descending) {
+		return 0, "", ErrInvalidCursor
+	}
+	key, err := strconv.ParseInt(parts[2], 10, 64)
+	if err != nil {
+		return 0, "", ErrInvalidCursor
+	}
+	return key, parts[3], nil
+}
+
+func containsCategory(categories []types.PaymentCategory, category types.PaymentCategory) bool {
+	for _, item := range categories {
+		if item == category {
+			return true
+		}
+	}
+	return false
+}
+
+func containsStatus(statuses []types.PaymentStatus, status types.PaymentStatus) bool {
+	for _, item := range statuses {
+		if item == status {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,163 @@
+package wallet
+
+import (
+	"context"
+	"runtime"
+	"sort"
+	"time"
+
+	"github.com/ilhom0258/wallet/pkg/types"
+)
+
+// Period is span of time SpendingReport groups payments by
+type Period int
+
+const (
+	// PeriodAll puts payments of all time into one group
+	PeriodAll Period = iota
+	// PeriodDay groups payments by day
+	PeriodDay
+	// PeriodWeek groups payments by week starting on Monday
+	PeriodWeek
+	// PeriodMonth groups payments by calendar month
+	PeriodMonth
+)
+
+// ReportOptions configures SpendingReport. Zero value reports spending of
+// all accounts by category over all time.
+type ReportOptions struct {
+	// AccountID limits the report to the account, zero reports all accounts
+	AccountID int64
+	// ByAccount splits rows of categories by account
+	ByAccount bool
+	// Period splits rows of categories by time of creation of payments
+	Period Period
+	// From and To limit the report to payments created in [From, To), zero
+	// value leaves the range open from that side
+	From time.Time
+	To   time.Time
+	// Statuses selects payments by status, empty selects all but failed
+	Statuses []types.PaymentStatus
+}
+
+// SpendingRow is spending of a category in a group of SpendingReport
+type SpendingRow struct {
+	Category types.PaymentCategory
+	// AccountID is zero unless the report is split by account or limited
+	// to one
+	AccountID int64
+	// Start is beginning of the period in UTC, zero for PeriodAll
+	Start   time.Time
+	Total   types.Money
+	Count   int
+	Average types.Money
+}
+
+// SpendingReport sums payments by category and optionally by account and
+// period. Incoming transfers aren't spending and are left out. Rows are
+// sorted by account, period and category.
+func (s *Service) SpendingReport(options ReportOptions) ([]SpendingRow, error) {
+	return s.SpendingReportContext(context.Background(), options)
+}
+
+// SpendingReportContext builds report like SpendingReport and stops when
+// ctx is done
+func (s *Service) SpendingReportContext(ctx context.Context, options ReportOptions) ([]SpendingRow, error) {
+	if options.Period < PeriodAll || options.Period > PeriodMonth {
+		return nil, ErrUnknownPeriod
+	}
+	statuses := options.Statuses
+	if len(statuses) == 0 {
+		statuses = []types.PaymentStatus{types.PaymentStatusInProgress, types.PaymentStatusConfirmed, types.PaymentStatusOk}
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	payments := s.storage().Payments()
+	if options.AccountID != 0 {
+		if s.findAccount(options.AccountID) == nil {
+			return nil, ErrAccountNotFound
+		}
+		payments = s.storage().PaymentsByAccount(options.AccountID)
+	}
+
+	type group struct {
+		category  types.PaymentCategory
+		accountID int64
+		start     time.Time
+	}
+	groups, err := reducePayments(ctx, payments, Parallel{Goroutines: runtime.GOMAXPROCS(0)}, Reducer{
+		Zero: func() interface{} {
+			return map[group]*PaymentStats{}
+		},
+		Fold: func(acc interface{}, payment types.Payment) interface{} {
+			if payment.Category == types.PaymentCategoryTransferIn ||
+				!containsStatus(statuses, payment.Status) ||
+				!inRange(payment.Created, options.From, options.To) {
+				return acc
+			}
+			key := group{category: payment.Category, start: periodStart(payment.Created, options.Period)}
+			if options.ByAccount || options.AccountID != 0 {
+				key.accountID = payment.AccountID
+			}
+			stats := acc.(map[group]*PaymentStats)
+			if stats[key] == nil {
+				stats[key] = &PaymentStats{}
+			}
+			stats[key].add(payment)
+			return stats
+		},
+		Merge: func(acc interface{}, part interface{}) interface{} {
+			stats := acc.(map[group]*PaymentStats)
+			for key, partStats := range part.(map[group]*PaymentStats) {
+				if stats[key] == nil {
+					stats[key] = &PaymentStats{}
+				}
+				stats[key].merge(*partStats)
+			}
+			return stats
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	rows := []SpendingRow{}
+	for key, stats := range groups.(map[group]*PaymentStats) {
+		rows = append(rows, SpendingRow{
+			Category:  key.category,
+			AccountID: key.accountID,
+			Start:     key.start,
+			Total:     stats.Sum,
+			Count:     stats.Count,
+			Average:   stats.Sum / types.Money(stats.Count),
+		})
+	}
+	sort.Slice(rows, func(i, j int) bool {
+		if rows[i].AccountID != rows[j].AccountID {
+			return rows[i].AccountID < rows[j].AccountID
+		}
+		if !rows[i].Start.Equal(rows[j].Start) {
+			return rows[i].Start.Before(rows[j].Start)
+		}
+		return rows[i].Category < rows[j].Category
+	})
+	return rows, nil
+}
+
+// periodStart returns beginning of the period t belongs to in UTC
+func periodStart(t time.Time, period Period) time.Time {
+	t = t.UTC()
+	switch period {
+	case PeriodDay:
+		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	case PeriodWeek:
+		day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+		return day.AddDate(0, 0, -(int(day.Weekday())+6)%7)
+	case PeriodMonth:
+		return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+	default:
+		return time.Time{}
+	}
+}
@@ -0,0 +1,291 @@
+package wallet
+
+import (
+	"sort"
+
+	"github.com/ilhom0258/wallet/pkg/ledger"
+	"github.com/ilhom0258/wallet/pkg/types"
+)
+
+// Repository is a storage backend of the Service.
+//
+// Records returned by a repository belong to it and must not be modified,
+// changed copies are stored back with Save. Service serializes all calls to
+// Save and may call read methods concurrently, so implementations have to be
+// safe for concurrent reads only.
+type Repository interface {
+	// Accounts returns all accounts in order of insertion
+	Accounts() []*types.Account
+	// AccountByID returns ErrAccountNotFound if there is no such account
+	AccountByID(id int64) (*types.Account, error)
+	// AccountByPhone returns ErrAccountNotFound if there is no such account
+	AccountByPhone(phone types.Phone) (*types.Account, error)
+
+	// Payments returns all payments in order of insertion
+	Payments() []*types.Payment
+	// PaymentByID returns ErrPaymentNotFound if there is no such payment
+	PaymentByID(id string) (*types.Payment, error)
+	// PaymentsByAccount returns payments of the account in order of insertion
+	PaymentsByAccount(accountID int64) []*types.Payment
+	// PaymentTransitions returns status changes of the payment, oldest first
+	PaymentTransitions(paymentID string) []*types.PaymentTransition
+
+	// Favorites returns all favorites in order of insertion
+	Favorites() []*types.Favorite
+	// FavoriteByID returns ErrFavoriteNotFound if there is no such favorite
+	FavoriteByID(id string) (*types.Favorite, error)
+	// FavoritesByAccount returns favorites of the account in order of insertion
+	FavoritesByAccount(accountID int64) []*types.Favorite
+
+	// IdempotencyRecords returns all saved idempotency keys
+	IdempotencyRecords() []*IdempotencyRecord
+	// IdempotencyRecord returns ErrIdempotencyKeyNotFound for unknown keys
+	IdempotencyRecord(key string) (*IdempotencyRecord, error)
+
+	// Entries returns all ledger entries in order of posting
+	Entries() []*ledger.Entry
+
+	// Save stores all records of changes at once. Records replace stored
+	// records with the same ID, others are appended. Transitions and ledger
+	// entries are always appended.
+	Save(changes Changes) error
+}
+
+// Changes is a set of records saved to Repository atomically
+type Changes struct {
+	Accounts  []*types.Account  `json:"accounts,omitempty"`
+	Payments  []*types.Payment  `json:"payments,omitempty"`
+	Favorites []*types.Favorite `json:"favorites,omitempty"`
+
+	Transitions        []*types.PaymentTransition `json:"transitions,omitempty"`
+	IdempotencyRecords []*IdempotencyRecord       `json:"idempotency_records,omitempty"`
+	Entries            []*ledger.Entry            `json:"entries,omitempty"`
+}
+
+// MemoryRepository keeps all records in memory. Records are indexed by ID,
+// accounts also by phone, payments and favorites also by account, so lookups
+// don't depend on the number of records.
+type MemoryRepository struct {
+	accounts  []*types.Account
+	payments  []*types.Payment
+	favorites []*types.Favorite
+
+	// indexes keep positions of records in the slices above
+	accountIndex     map[int64]int
+	phoneIndex       map[types.Phone]int
+	paymentIndex     map[string]int
+	accountPayments  map[int64][]int
+	favoriteIndex    map[string]int
+	accountFavorites map[int64][]int
+
+	transitions map[string][]*types.PaymentTransition
+	keys        []*IdempotencyRecord
+	keyIndex    map[string]*IdempotencyRecord
+	entries     []*ledger.Entry
+}
+
+// NewMemoryRepository creates empty in-memory repository
+func NewMemoryRepository() *MemoryRepository {
+	return &MemoryRepository{
+		accountIndex:     make(map[int64]int),
+		phoneIndex:       make(map[types.Phone]int),
+		paymentIndex:     make(map[string]int),
+		accountPayments:  make(map[int64][]int),
+		favoriteIndex:    make(map[string]int),
+		accountFavorites: make(map[int64][]int),
+		transitions:      make(map[string][]*types.PaymentTransition),
+		keyIndex:         make(map[string]*IdempotencyRecord),
+	}
+}
+
+// Accounts returns all stored accounts
+func (r *MemoryRepository) Accounts() []*types.Account {
+	return r.accounts
+}
+
+// AccountByID finds account by ID
+func (r *MemoryRepository) AccountByID(id int64) (*types.Account, error) {
+	i, ok := r.accountIndex[id]
+	if !ok {
+		return nil, ErrAccountNotFound
+	}
+	return r.accounts[i], nil
+}
+
+// AccountByPhone finds account by phone
+func (r *MemoryRepository) AccountByPhone(phone types.Phone) (*types.Account, error) {
+	i, ok := r.phoneIndex[phone]
+	if !ok {
+		return nil, ErrAccountNotFound
+	}
+	return r.accounts[i], nil
+}
+
+// Payments returns all stored payments
+func (r *MemoryRepository) Payments() []*types.Payment {
+	return r.payments
+}
+
+// PaymentByID finds payment by ID
+func (r *MemoryRepository) PaymentByID(id string) (*types.Payment, error) {
+	i, ok := r.paymentIndex[id]
+	if !ok {
+		return nil, ErrPaymentNotFound
+	}
+	return r.payments[i], nil
+}
+
+// PaymentsByAccount returns payments of the account
+func (r *MemoryRepository) PaymentsByAccount(accountID int64) []*types.Payment {
+	positions := r.accountPayments[accountID]
+	payments := make([]*types.Payment, len(positions))
+	for i, position := range positions {
+		payments[i] = r.payments[position]
+	}
+	return payments
+}
+
+// PaymentTransitions returns history of the payment
+func (r *MemoryRepository) PaymentTransitions(paymentID string) []*types.PaymentTransition {
+	return r.transitions[paymentID]
+}
+
+// Favorites returns all stored favorites
+func (r *MemoryRepository) Favorites() []*types.Favorite {
+	return r.favorites
+}
+
+// FavoriteByID finds favorite by ID
+func (r *MemoryRepository) FavoriteByID(id string) (*types.Favorite, error) {
+	i, ok := r.favoriteIndex[id]
+	if !ok {
+		return nil, ErrFavoriteNotFound
+	}
+	return r.favorites[i], nil
+}
+
+// FavoritesByAccount returns favorites of the account
+func (r *MemoryRepository) FavoritesByAccount(accountID int64) []*types.Favorite {
+	positions := r.accountFavorites[accountID]
+	favorites := make([]*types.Favorite, len(positions))
+	for i, position := range positions {
+		favorites[i] = r.favorites[position]
+	}
+	return favorites
+}
+
+// IdempotencyRecords returns all stored keys
+func (r *MemoryRepository) IdempotencyRecords() []*IdempotencyRecord {
+	return r.keys
+}
+
+// IdempotencyRecord finds record by key
+func (r *MemoryRepository) IdempotencyRecord(key string) (*IdempotencyRecord, error) {
+	record, ok := r.keyIndex[key]
+	if !ok {
+		return nil, ErrIdempotencyKeyNotFound
+	}
+	return record, nil
+}
+
+// Entries returns all stored ledger entries
+func (r *MemoryRepository) Entries() []*ledger.Entry {
+	return r.entries
+}
+
+// Save stores changes in memory, it never fails
+func (r *MemoryRepository) Save(changes Changes) error {
+	for _, account := range changes.Accounts {
+		r.saveAccount(account)
+	}
+	for _, payment := range changes.Payments {
+		r.savePayment(payment)
+	}
+	for _, favorite := range changes.Favorites {
+		r.saveFavorite(favorite)
+	}
+	for _, transition := range changes.Transitions {
+		r.transitions[transition.PaymentID] = append(r.transitions[transition.PaymentID], transition)
+	}
+	for _, record := range changes.IdempotencyRecords {
+		r.saveIdempotencyRecord(record)
+	}
+	r.entries = append(r.entries, changes.Entries...)
+	return nil
+}
+
+func (r *MemoryRepository) saveAccount(account *types.Account) {
+	i, ok := r.accountIndex[account.ID]
+	if !ok {
+		i = len(r.accounts)
+		r.accounts = append(r.accounts, account)
+		r.accountIndex[account.ID] = i
+	} else if stored := r.accounts[i]; stored.Phone != account.Phone && r.phoneIndex[stored.Phone] == i {
+		delete(r.phoneIndex, stored.Phone)
+	}
+	r.accounts[i] = account
+	r.phoneIndex[account.Phone] = i
+}
+
+func (r *MemoryRepository) savePayment(payment *types.Payment) {
+	i, ok := r.paymentIndex[payment.ID]
+	if !ok {
+		i = len(r.payments)
+		r.payments = append(r.payments, payment)
+		r.paymentIndex[payment.ID] = i
+		r.accountPayments[payment.AccountID] = append(r.accountPayments[payment.AccountID], i)
+		return
+	}
+	if stored := r.payments[i]; stored.AccountID != payment.AccountID {
+		r.accountPayments[stored.AccountID] = removePosition(r.accountPayments[stored.AccountID], i)
+		r.accountPayments[payment.AccountID] = insertPosition(r.accountPayments[payment.AccountID], i)
+	}
+	r.payments[i] = payment
+}
+
+func (r *MemoryRepository) saveFavorite(favorite *types.Favorite) {
+	i, ok := r.favoriteIndex[favorite.ID]
+	if !ok {
+		i = len(r.favorites)
+		r.favorites = append(r.favorites, favorite)
+		r.favoriteIndex[favorite.ID] = i
+		r.accountFavorites[favorite.AccountID] = append(r.accountFavorites[favorite.AccountID], i)
+		return
+	}
+	if stored := r.favorites[i]; stored.AccountID != favorite.AccountID {
+		r.accountFavorites[stored.AccountID] = removePosition(r.accountFavorites[stored.AccountID], i)
+		r.accountFavorites[favorite.AccountID] = insertPosition(r.accountFavorites[favorite.AccountID], i)
+	}
+	r.favorites[i] = favorite
+}
+
+func (r *MemoryRepository) saveIdempotencyRecord(record *IdempotencyRecord) {
+	if _, ok := r.keyIndex[record.Key]; ok {
+		for i, stored := range r.keys {
+			if stored.Key == record.Key {
+				r.keys[i] = record
+			}
+		}
+	} else {
+		r.keys = append(r.keys, record)
+	}
+	r.keyIndex[record.Key] = record
+}
+
+// removePosition removes position from sorted positions
+func removePosition(positions []int, position int) []int {
+	i := sort.SearchInts(positions, position)
+	if i == len(positions) || positions[i] != position {
+		return positions
+	}
+	return append(positions[:i], positions[i+1:]...)
+}
+
+// insertPosition adds position to sorted positions keeping them sorted
+func insertPosition(positions []int, position int) []int {
+	i := sort.SearchInts(positions, position)
+	positions = append(positions, 0)
+	copy(positions[i+1:], positions[i:])
+	positions[i] = position
+	return positions
+}
@@ -0,0 +1,186 @@
+package wallet
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ilhom0258/wallet/pkg/types"
+)
+
+func TestMemoryRepository_Save_replacesByID(t *testing.T) {
+	repo := NewMemoryRepository()
+	err := repo.Save(Changes{Accounts: []*types.Account{{ID: 1, Phone: "+992000000001"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = repo.Save(Changes{Accounts: []*types.Account{{ID: 1, Phone: "+992000000001", Balance: 10}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(repo.Accounts()) != 1 {
+		t.Fatalf("accounts = %v, want 1", len(repo.Accounts()))
+	}
+	account, err := repo.AccountByPhone("+992000000001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if account.Balance != 10 {
+		t.Errorf("balance = %v, want 10", account.Balance)
+	}
+	if _, err := repo.PaymentByID("unknown"); err != ErrPaymentNotFound {
+		t.Errorf("err = %v, want %v", err, ErrPaymentNotFound)
+	}
+}
+
+func TestFileRepository_reopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "wallet.journal")
+	repo, err := OpenFileRepository(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewService(repo)
+	_, payments, err := (&testService{Service: s}).addAccount(defaultTestAccount)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.FavoritePayment(payments[0].ID, "mobile"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Reject(payments[1].ID); err != nil {
+		t.Fatal(err)
+	}
+	want, err := s.FindAccountByID(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	repo, err = OpenFileRepository(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repo.Close()
+	s = NewService(repo)
+	got, err := s.FindAccountByID(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *got != *want {
+		t.Errorf("account = %v, want %v", got, want)
+	}
+	if len(repo.Payments()) != len(payments) || len(repo.Favorites()) != 1 {
+		t.Errorf("payments = %v, favorites = %v", len(repo.Payments()), len(repo.Favorites()))
+	}
+	payment, err := repo.PaymentByID(payments[1].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if payment.Status != types.PaymentStatusFail {
+		t.Errorf("status = %v, want %v", payment.Status, types.PaymentStatusFail)
+	}
+	account, err := s.RegisterAccount("+992000000002")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if account.ID != 2 {
+		t.Errorf("id = %v, want 2", account.ID)
+	}
+}
+
+func TestFileRepository_tornWrite(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "wallet.journal")
+	repo, err := OpenFileRepository(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewService(repo).RegisterAccount("+992000000001"); err != nil {
+		t.Fatal(err)
+	}
+	repo.Close()
+
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := file.WriteString(`{"accounts":[{"id":2,`); err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+
+	repo, err = OpenFileRepository(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repo.Close()
+	if len(repo.Accounts()) != 1 {
+		t.Fatalf("accounts = %v, want 1", len(repo.Accounts()))
+	}
+	if _, err := NewService(repo).RegisterAccount("+992000000002"); err != nil {
+		t.Fatal(err)
+	}
+	if len(repo.Accounts()) != 2 {
+		t.Errorf("accounts = %v, want 2", len(repo.Accounts()))
+	}
+}
+
+func TestFileRepository_corrupted(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "wallet.journal")
+	if err := ioutil.WriteFile(path, []byte("garbage\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenFileRepository(path); err != ErrCorruptedJournal {
+		t.Errorf("err = %v, want %v", err, ErrCorruptedJournal)
+	}
+}
+
+func TestMemoryRepository_indexes(t *testing.T) {
+	repo := NewMemoryRepository()
+	err := repo.Save(Changes{
+		Accounts: []*types.Account{{ID: 1, Phone: "+992000000001"}, {ID: 2, Phone: "+992000000002"}},
+		Payments: []*types.Payment{
+			{ID: "p1", AccountID: 1},
+			{ID: "p2", AccountID: 2},
+			{ID: "p3", AccountID: 1},
+		},
+		Favorites: []*types.Favorite{{ID: "f1", AccountID: 1}, {ID: "f2", AccountID: 2}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = repo.Save(Changes{
+		Accounts:  []*types.Account{{ID: 1, Phone: "+992000000003"}},
+		Payments:  []*types.Payment{{ID: "p2", AccountID: 1, Amount: 10}},
+		Favorites: []*types.Favorite{{ID: "f1", AccountID: 2}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := repo.AccountByPhone("+992000000001"); err != ErrAccountNotFound {
+		t.Errorf("old phone err = %v, want %v", err, ErrAccountNotFound)
+	}
+	if account, err := repo.AccountByPhone("+992000000003"); err != nil || account.ID != 1 {
+		t.Errorf("new phone account = %v, %v, want 1", account, err)
+	}
+	if payment, err := repo.PaymentByID("p2"); err != nil || payment.Amount != 10 {
+		t.Errorf("payment p2 = %v, %v, want amount 10", payment, err)
+	}
+	payments := repo.PaymentsByAccount(1)
+	if len(payments) != 3 || payments[0].ID != "p1" || payments[1].ID != "p2" || payments[2].ID != "p3" {
+		t.Errorf("payments of account 1 = %v, want p1, p2, p3", payments)
+	}
+	if payments := repo.PaymentsByAccount(2); len(payments) != 0 {
+		t.Errorf("payments of account 2 = %v, want none", payments)
+	}
+	favorites := repo.FavoritesByAccount(2)
+	if len(favorites) != 2 || favorites[0].ID != "f1" || favorites[1].ID != "f2" {
+		t.Errorf("favorites of account 2 = %v, want f1, f2", favorites)
+	}
+	if favorite, err := repo.FavoriteByID("f1"); err != nil || favorite.AccountID != 2 {
+		t.Errorf("favorite f1 = %v, %v, want account 2", favorite, err)
+	}
+}
@@ -1,35 +1,80 @@
 package wallet
 
 import (
+	"bufio"
+	"context"
 	"errors"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"log"
-	"math"
 	"os"
 	"path/filepath"
-	"reflect"
+	"runtime"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/google/uuid"
+	"github.com/ilhom0258/wallet/pkg/ledger"
 	"github.com/ilhom0258/wallet/pkg/types"
 )
 
-//Service structure for wallet and other services
+// Service structure for wallet and other services
+//
+// Service is safe for concurrent use by multiple goroutines. Methods return
+// copies of stored accounts, payments and favorites, so callers never share
+// memory with the service.
+//
+// Zero value Service keeps its data in a MemoryRepository, use NewService to
+// choose another storage.
 type Service struct {
+	mu            sync.RWMutex
+	init          sync.Once
+	repo          Repository
+	clock         Clock
 	nextAccountID int64
-	accounts      []*types.Account
-	payments      []*types.Payment
-	favorites     []*types.Favorite
 }
 
-//Progress structure for sum calculating
-type Progress struct{
+// Clock returns current time
+type Clock func() time.Time
+
+// Option configures Service created by NewService
+type Option func(s *Service)
+
+// WithClock makes service take time of payments and ledger entries from clock
+func WithClock(clock Clock) Option {
+	return func(s *Service) {
+		s.clock = clock
+	}
+}
+
+// NewService creates service which keeps its data in repo
+func NewService(repo Repository, options ...Option) *Service {
+	s := &Service{repo: repo}
+	for _, option := range options {
+		option(s)
+	}
+	for _, account := range repo.Accounts() {
+		if account.ID > s.nextAccountID {
+			s.nextAccountID = account.ID
+		}
+	}
+	return s
+}
+
+// Progress reports a part summed by SumPaymentsWithProgress
+type Progress struct {
+	// Part is 0-based index of the part
 	Part int
+	// Result is sum of payments of the part
 	Result types.Money
+	// Done is number of parts summed so far including this one
+	Done int
+	// Parts is number of all parts
+	Parts int
+	// Total is sum of payments of all parts summed so far
+	Total types.Money
 }
 
 //Error message
@@ -66,152 +111,314 @@ var ErrInParsing = errors.New("error in parsing")
 //ErrInReadingFromFile Common Error
 var ErrInReadingFromFile = errors.New("error in reading from file")
 
+// ErrTransferToSameAccount is returned when money is transferred to the source account
+var ErrTransferToSameAccount = errors.New("can't transfer to the same account")
+
+// ErrTransferPayment is returned when operation isn't allowed for transfer payments
+var ErrTransferPayment = errors.New("operation is not allowed for transfer payment")
+
+// ErrInvalidTransition is matched by errors.Is for every TransitionError
+var ErrInvalidTransition = errors.New("invalid payment status transition")
+
+// ErrIdempotencyKeyReused is returned when idempotency key is used for another request
+var ErrIdempotencyKeyReused = errors.New("idempotency key is already used for another request")
+
+// ErrIdempotencyKeyNotFound is returned by Repository for unknown keys
+var ErrIdempotencyKeyNotFound = errors.New("idempotency key not found")
+
+// ErrLedgerMismatch is returned when balance of account differs from the ledger
+var ErrLedgerMismatch = errors.New("balance doesn't match the ledger")
+
+// ErrCorruptedJournal is returned when FileRepository journal can't be read
+var ErrCorruptedJournal = errors.New("repository journal is corrupted")
+
+// ErrCorruptedDump is returned when .dump file doesn't match its header
+var ErrCorruptedDump = errors.New("dump file is corrupted")
+
+// ErrUnsupportedDumpVersion is returned for .dump files of unknown versions
+var ErrUnsupportedDumpVersion = errors.New("unsupported dump version")
+
+// ErrMissingChunk is returned when payment chunk written by HistoryToFiles is missing
+var ErrMissingChunk = errors.New("payment chunk is missing")
+
+// ErrImportConflict is returned when imported record differs from the stored
+// one and MergeFail policy is used, or when phone of imported account belongs
+// to another stored account
+var ErrImportConflict = errors.New("imported record conflicts with stored one")
+
+// ErrUnknownFormat is returned for export formats the service doesn't support
+var ErrUnknownFormat = errors.New("unknown export format")
+
+// ErrNotExportDir is returned for directories which current entry isn't a
+// link to a generation written by export
+var ErrNotExportDir = errors.New("current is not a link to an export")
+
+// ErrInvalidCursor is returned when page cursor of PaymentQuery can't be decoded
+// or was issued for another sort order
+var ErrInvalidCursor = errors.New("invalid page cursor")
+
+// ErrUnknownPeriod is returned for report periods the service doesn't support
+var ErrUnknownPeriod = errors.New("unknown report period")
+
 // RegisterAccount function for registering wallet account for user
 func (s *Service) RegisterAccount(phone types.Phone) (*types.Account, error) {
-	for _, account := range s.accounts {
-		if account.Phone == phone {
-			return nil, ErrPhoneRegistered
-		}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, err := s.storage().AccountByPhone(phone); err == nil {
+		return nil, ErrPhoneRegistered
 	}
-	s.nextAccountID++
 	account := &types.Account{
-		ID:      s.nextAccountID,
+		ID:      s.nextAccountID + 1,
 		Phone:   phone,
 		Balance: 0,
 	}
-	s.accounts = append(s.accounts, account)
-	return account, nil
+	if err := s.storage().Save(Changes{Accounts: []*types.Account{account}}); err != nil {
+		return nil, err
+	}
+	s.nextAccountID++
+	return copyAccount(account), nil
 }
 
 //Deposit function for
 func (s *Service) Deposit(accountID int64, amount types.Money) error {
-	var acc *types.Account
+	return s.DepositWithKey("", accountID, amount)
+}
+
+// deposit prepares deposit, caller must hold the write lock and save changes
+func (s *Service) deposit(accountID int64, amount types.Money) (Changes, error) {
 	if amount <= 0 {
-		return ErrAmountMustBePositive
-	}
-	for _, account := range s.accounts {
-		if account.ID == accountID {
-			acc = account
-		}
+		return Changes{}, ErrAmountMustBePositive
 	}
+	acc := s.findAccount(accountID)
 	if acc == nil {
-		return ErrAccountNotFound
+		return Changes{}, ErrAccountNotFound
 	}
-	acc.Balance += amount
-	return nil
+	account := copyAccount(acc)
+	changes := Changes{Accounts: []*types.Account{account}}
+	entry := ledger.Move(ledger.KindDeposit, "", ledger.CashIn, ledger.Wallet(accountID), amount, s.now())
+	if err := changes.journal(entry, account); err != nil {
+		return Changes{}, err
+	}
+	return changes, nil
 }
 
 // Pay function for making payments
 func (s *Service) Pay(accountID int64, amount types.Money, category types.PaymentCategory) (*types.Payment, error) {
+	return s.PayWithKey("", accountID, amount, category)
+}
+
+// pay prepares payment, caller must hold the write lock and save changes
+func (s *Service) pay(accountID int64, amount types.Money, category types.PaymentCategory) (*types.Payment, Changes, error) {
 	if amount <= 0 {
-		return nil, ErrAmountMustBePositive
-	}
-	var account *types.Account
-	for _, acc := range s.accounts {
-		if acc.ID == accountID {
-			account = acc
-			break
-		}
+		return nil, Changes{}, ErrAmountMustBePositive
 	}
+	account := s.findAccount(accountID)
 	if account == nil {
-		return nil, ErrAccountNotFound
+		return nil, Changes{}, ErrAccountNotFound
 	}
 	if account.Balance < amount {
-		return nil, ErrNotEnoughBalance
+		return nil, Changes{}, ErrNotEnoughBalance
 	}
 
 	paymentID := uuid.New().String()
+	now := s.now()
 	payment := &types.Payment{
 		ID:        paymentID,
 		AccountID: accountID,
 		Amount:    amount,
 		Category:  category,
 		Status:    types.PaymentStatusInProgress,
+		Created:   now,
+		Updated:   now,
 	}
-	account.Balance -= amount
-	s.payments = append(s.payments, payment)
-	return payment, nil
+	account = copyAccount(account)
+	changes := Changes{
+		Accounts:    []*types.Account{account},
+		Payments:    []*types.Payment{payment},
+		Transitions: []*types.PaymentTransition{created(payment)},
+	}
+	entry := ledger.Move(ledger.KindPayment, paymentID, ledger.Wallet(accountID), ledger.MerchantClearing, amount, now)
+	if err := changes.journal(entry, account); err != nil {
+		return nil, Changes{}, err
+	}
+	return payment, changes, nil
+}
+
+// Transfer moves amount from one account to another. Both sides are recorded
+// as payments linked to each other, the payment of the source account is returned.
+func (s *Service) Transfer(fromID int64, toID int64, amount types.Money) (*types.Payment, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	payment, err := s.transfer(fromID, toID, amount)
+	if err != nil {
+		return nil, err
+	}
+	return copyPayment(payment), nil
+}
+
+// TransferByPhone moves amount to account registered with phone
+func (s *Service) TransferByPhone(fromID int64, phone types.Phone, amount types.Money) (*types.Payment, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	to, err := s.storage().AccountByPhone(phone)
+	if err != nil {
+		return nil, err
+	}
+	payment, err := s.transfer(fromID, to.ID, amount)
+	if err != nil {
+		return nil, err
+	}
+	return copyPayment(payment), nil
+}
+
+// transfer makes transfer, caller must hold the write lock
+func (s *Service) transfer(fromID int64, toID int64, amount types.Money) (*types.Payment, error) {
+	if amount <= 0 {
+		return nil, ErrAmountMustBePositive
+	}
+	if fromID == toID {
+		return nil, ErrTransferToSameAccount
+	}
+	from := s.findAccount(fromID)
+	to := s.findAccount(toID)
+	if from == nil || to == nil {
+		return nil, ErrAccountNotFound
+	}
+	if from.Balance < amount {
+		return nil, ErrNotEnoughBalance
+	}
+
+	now := s.now()
+	debit := &types.Payment{
+		ID:        uuid.New().String(),
+		AccountID: fromID,
+		Amount:    amount,
+		Category:  types.PaymentCategoryTransferOut,
+		Status:    types.PaymentStatusOk,
+		Created:   now,
+		Updated:   now,
+	}
+	credit := &types.Payment{
+		ID:        uuid.New().String(),
+		AccountID: toID,
+		Amount:    amount,
+		Category:  types.PaymentCategoryTransferIn,
+		Status:    types.PaymentStatusOk,
+		Created:   now,
+		Updated:   now,
+	}
+	debit.LinkedID = credit.ID
+	credit.LinkedID = debit.ID
+
+	from = copyAccount(from)
+	to = copyAccount(to)
+	changes := Changes{
+		Accounts:    []*types.Account{from, to},
+		Payments:    []*types.Payment{debit, credit},
+		Transitions: []*types.PaymentTransition{created(debit), created(credit)},
+	}
+	entry := ledger.Move(ledger.KindTransfer, debit.ID, ledger.Wallet(fromID), ledger.Wallet(toID), amount, now)
+	if err := changes.journal(entry, from, to); err != nil {
+		return nil, err
+	}
+	if err := s.storage().Save(changes); err != nil {
+		return nil, err
+	}
+	return debit, nil
 }
 
 //FindAccountByID function that finds account by ID
 func (s *Service) FindAccountByID(accountID int64) (*types.Account, error) {
-	var account *types.Account
-	for _, acc := range s.accounts {
-		if acc.ID == accountID {
-			account = acc
-			break
-		}
-	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	account := s.findAccount(accountID)
 	if account == nil {
 		return nil, ErrAccountNotFound
 	}
-	return account, nil
+	return copyAccount(account), nil
 }
 
 //FindPaymentByID function seaches for payment with ID
 func (s *Service) FindPaymentByID(paymentID string) (*types.Payment, error) {
-	var payment *types.Payment
-	for _, pmnt := range s.payments {
-		if paymentID == pmnt.ID && pmnt.Status == types.PaymentStatusInProgress {
-			payment = pmnt
-			break
-		}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	payment, err := s.findPaymentInProgress(paymentID)
+	if err != nil {
+		return nil, err
 	}
-	if payment == nil {
+	return copyPayment(payment), nil
+}
+
+func (s *Service) findPaymentInProgress(paymentID string) (*types.Payment, error) {
+	payment := s.findPayment(paymentID)
+	if payment == nil || payment.Status != types.PaymentStatusInProgress {
 		return nil, ErrPaymentNotFound
 	}
 
 	return payment, nil
 }
 
-//Reject cancels payment which ProgressStatus
-//930777607
+//Reject cancels payment which is in progress or confirmed and returns money to the account
 func (s *Service) Reject(paymentID string) error {
-	var payment *types.Payment
-	for _, pmnt := range s.payments {
-		if pmnt.ID == paymentID {
-			payment = pmnt
-			break
-		}
-	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	payment := s.findPayment(paymentID)
 	if payment == nil {
 		return ErrPaymentNotFound
 	}
-	payment.Status = types.PaymentStatusFail
-	var account *types.Account
-	for _, acc := range s.accounts {
-		if acc.ID == payment.AccountID {
-			account = acc
-			break
-		}
+	if payment.LinkedID != "" {
+		return ErrTransferPayment
 	}
-	account.Balance += payment.Amount
-	return nil
+	account := s.findAccount(payment.AccountID)
+	if account == nil {
+		return ErrAccountNotFound
+	}
+	payment, transition, err := transit(payment, types.PaymentEventReject, s.now())
+	if err != nil {
+		return err
+	}
+	account = copyAccount(account)
+	changes := Changes{
+		Accounts:    []*types.Account{account},
+		Payments:    []*types.Payment{payment},
+		Transitions: []*types.PaymentTransition{transition},
+	}
+	entry := ledger.Move(ledger.KindRefund, payment.ID, ledger.MerchantClearing, ledger.Wallet(account.ID), payment.Amount, payment.Updated)
+	if err := changes.journal(entry, account); err != nil {
+		return err
+	}
+	return s.storage().Save(changes)
 }
 
 //Repeat function that repeats payment with different UUID
 func (s *Service) Repeat(paymentID string) (*types.Payment, error) {
-	var payment *types.Payment
-	for _, pmnt := range s.payments {
-		if pmnt.ID == paymentID {
-			payment = pmnt
-			break
-		}
-	}
+	return s.RepeatWithKey("", paymentID)
+}
+
+// repeat prepares repeated payment, caller must hold the write lock and save changes
+func (s *Service) repeat(paymentID string) (*types.Payment, Changes, error) {
+	payment := s.findPayment(paymentID)
 	if payment == nil {
-		return nil, ErrPaymentNotFound
+		return nil, Changes{}, ErrPaymentNotFound
 	}
-	payment, err := s.Pay(payment.AccountID, payment.Amount, payment.Category)
-	if err != nil {
-		return nil, err
+	if payment.LinkedID != "" {
+		return nil, Changes{}, ErrTransferPayment
 	}
-	return payment, nil
+	return s.pay(payment.AccountID, payment.Amount, payment.Category)
 }
 
 //FavoritePayment function for creating favorite payment
 func (s *Service) FavoritePayment(paymentID string, name string) (*types.Favorite, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
-	payment, err := s.FindPaymentByID(paymentID)
+	payment, err := s.findPaymentInProgress(paymentID)
 	if err != nil {
 		return nil, err
 	}
@@ -225,81 +432,110 @@ func (s *Service) FavoritePayment(paymentID string, name string) (*types.Favorit
 		Amount:    payment.Amount,
 		Category:  payment.Category,
 	}
-	s.favorites = append(s.favorites, favorite)
-	return favorite, nil
+	if err := s.storage().Save(Changes{Favorites: []*types.Favorite{favorite}}); err != nil {
+		return nil, err
+	}
+	return copyFavorite(favorite), nil
 }
 
-//PayFromFavorite function for favorite payment for user
-func (s *Service) PayFromFavorite(favoriteID string) (*types.Payment, error) {
-	var favorite *types.Favorite
-	for _, fvrt := range s.favorites {
-		if fvrt.ID == favoriteID {
-			favorite = fvrt
-			break
-		}
+// AccountFavorites returns favorites of the account
+func (s *Service) AccountFavorites(accountID int64) ([]types.Favorite, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.findAccount(accountID) == nil {
+		return nil, ErrAccountNotFound
 	}
-	if favorite == nil {
-		return nil, ErrFavoriteNotFound
+	favorites := []types.Favorite{}
+	for _, favorite := range s.storage().FavoritesByAccount(accountID) {
+		favorites = append(favorites, *favorite)
 	}
-	payment, err := s.Pay(favorite.AccountID, favorite.Amount, favorite.Category)
+	return favorites, nil
+}
+
+//PayFromFavorite function for favorite payment for user
+func (s *Service) PayFromFavorite(favoriteID string) (*types.Payment, error) {
+	return s.PayFromFavoriteWithKey("", favoriteID)
+}
+
+// payFromFavorite prepares payment, caller must hold the write lock and save changes
+func (s *Service) payFromFavorite(favoriteID string) (*types.Payment, Changes, error) {
+	favorite, err := s.storage().FavoriteByID(favoriteID)
 	if err != nil {
-		return nil, err
+		return nil, Changes{}, err
 	}
-	return payment, nil
+	return s.pay(favorite.AccountID, favorite.Amount, favorite.Category)
 }
 
 // ExportToFile exports data to file
 func (s *Service) ExportToFile(path string) error {
-	file, err := os.Create(path)
+	return s.ExportToFileContext(context.Background(), path)
+}
+
+// ExportToFileContext exports data like ExportToFile and stops when ctx is done
+func (s *Service) ExportToFileContext(ctx context.Context, path string) error {
+	accounts := s.snapshotAccounts()
+	err := writeFileStream(path, func(w io.Writer) error {
+		for i, account := range accounts {
+			if err := interrupted(ctx, i); err != nil {
+				return err
+			}
+			id := strconv.FormatInt(int64(account.ID), 10)
+			balance := strconv.FormatInt(int64(account.Balance), 10)
+			phone := string(account.Phone)
+			if _, err := io.WriteString(w, id+";"+phone+";"+balance+"|"); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if isContextError(err) {
+		return err
+	}
 	if err != nil {
-		log.Println(err)
+		log.Print(err)
 		return ErrWorkingDirectoryNotFound
 	}
-	defer func() {
-		if cerr := file.Close(); cerr != nil {
-			log.Print(cerr)
-		}
-	}()
-	for _, account := range s.accounts {
-		id := strconv.FormatInt(int64(account.ID), 10)
-		balance := strconv.FormatInt(int64(account.Balance), 10)
-		phone := string(account.Phone)
-		_, err := file.Write([]byte(id + ";" + phone + ";" + balance + "|"))
-		if err != nil {
-			log.Print(err)
-			return ErrWorkingDirectoryNotFound
-		}
-	}
 	return nil
 }
 
 // ImportFromFile imports data from file
 func (s *Service) ImportFromFile(path string) error {
+	return s.ImportFromFileContext(context.Background(), path)
+}
+
+// ImportFromFileContext imports data like ImportFromFile and stops when ctx
+// is done, nothing is saved then
+func (s *Service) ImportFromFileContext(ctx context.Context, path string) error {
 	file, err := os.Open(path)
 	if err != nil {
 		log.Print(err)
 		return ErrWorkingDirectoryNotFound
 	}
-	content := make([]byte, 0)
-	buf := make([]byte, 4)
+	defer func() {
+		if cerr := file.Close(); cerr != nil {
+			log.Print(cerr)
+		}
+	}()
+	reader := bufio.NewReaderSize(file, dumpBufferSize)
+	accounts := []*types.Account{}
 	for {
-		read, err := file.Read(buf)
-		if err == io.EOF {
-			break
+		if err := interrupted(ctx, len(accounts)); err != nil {
+			return err
 		}
-		if err != nil {
+		acc, err := reader.ReadString('|')
+		if err != nil && err != io.EOF {
 			log.Print(err)
 			return err
 		}
-		content = append(content, buf[:read]...)
-	}
-	data := string(content)
-	temp := strings.Split(data, "|")
-	for _, acc := range temp {
-		accountData := strings.Split(acc, ";")
+		acc = strings.TrimSuffix(acc, "|")
 		if acc == "" {
 			break
 		}
+		accountData := strings.Split(acc, ";")
+		if len(accountData) != 3 {
+			return ErrInParsing
+		}
 		id, err := strconv.ParseInt(accountData[0], 10, 64)
 		if err != nil {
 			log.Print(err)
@@ -316,269 +552,401 @@ func (s *Service) ImportFromFile(path string) error {
 			Phone:   types.Phone(phone),
 			Balance: types.Money(balance),
 		}
-		s.nextAccountID = id
-		s.accounts = append(s.accounts, account)
+		accounts = append(accounts, account)
 	}
-	return nil
-}
 
-// Export - exports data to file
-func (s *Service) Export(dir string) (err error) {
-	accounts := s.accounts
-	payments := s.payments
-	favorites := s.favorites
-	if len(accounts) != 0 {
-		path, err := pathMaker(dir, "accounts.dump")
-		err = exportAccounts(accounts, path)
-		log.Printf("%v error in accounts", err)
-	}
-	if len(payments) != 0 {
-		path, err := pathMaker(dir, "payments.dump")
-		err = exportPayments(payments, path)
-		log.Printf("%v error in paymentts", err)
-	}
-	if len(favorites) != 0 {
-		path, err := pathMaker(dir, "favorites.dump")
-		err = exportFavorites(favorites, path)
-		log.Printf("%v error in favorites", err)
+	if err := ctx.Err(); err != nil {
+		return err
 	}
-	return nil
-}
-
-//Import - import data from file
-func (s *Service) Import(dir string) (err error) {
-
-	path, err := filepath.Abs(dir)
-	fmt.Println(path)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	changes, err := s.loadAccounts(accounts, nil, nil)
 	if err != nil {
 		return err
 	}
-
-	if _, err := os.Stat(path); os.IsNotExist(err) {
+	if err := s.storage().Save(changes); err != nil {
 		return err
 	}
-	accountPath := path + "/accounts.dump"
-	paymentPath := path + "/payments.dump"
-	favoritePath := path + "/favorites.dump"
-	if s.fileExist(accountPath) {
-		log.Printf("here acc %v", accountPath)
-		err = importAccounts(accountPath, s)
-	}
-	if s.fileExist(paymentPath) {
-		log.Printf("here pay %v", paymentPath)
-		err = importPayments(paymentPath, s)
-	}
-	if s.fileExist(favoritePath) {
-		log.Printf("here fav %v", favoritePath)
-		err = importFavorites(favoritePath, s)
+	for _, account := range accounts {
+		if account.ID > s.nextAccountID {
+			s.nextAccountID = account.ID
+		}
 	}
 	return nil
 }
 
+// Export - exports data to file
+//
+// Journal entries of the ledger go to ledger.dump, so Import restores the
+// history of balances instead of adjusting them to the exported values.
+// The files are written into a new generation directory inside dir and
+// dir/current is switched to it at once, so readers see either the previous
+// or the new export as a whole. Other files of dir are kept.
+func (s *Service) Export(dir string) (err error) {
+	return s.ExportContext(context.Background(), dir)
+}
+
+// ExportContext exports data like Export and stops when ctx is done, dir
+// isn't changed then
+func (s *Service) ExportContext(ctx context.Context, dir string) error {
+	s.mu.RLock()
+	accounts := s.snapshotAccountsLocked()
+	payments := s.snapshotPaymentsLocked()
+	favorites := s.snapshotFavoritesLocked()
+	keys := s.snapshotIdempotencyRecordsLocked()
+	entries := s.snapshotEntriesLocked()
+	s.mu.RUnlock()
+
+	return exportAtomically(ctx, dir, dumpFiles, func(dir string) error {
+		if len(accounts) != 0 {
+			path, err := pathMaker(dir, "accounts.dump")
+			if err != nil {
+				return err
+			}
+			if err := exportAccounts(ctx, accounts, path); err != nil {
+				return err
+			}
+		}
+		if len(payments) != 0 {
+			path, err := pathMaker(dir, "payments.dump")
+			if err != nil {
+				return err
+			}
+			if err := exportPayments(ctx, payments, path); err != nil {
+				return err
+			}
+		}
+		if len(favorites) != 0 {
+			path, err := pathMaker(dir, "favorites.dump")
+			if err != nil {
+				return err
+			}
+			if err := exportFavorites(ctx, favorites, path); err != nil {
+				return err
+			}
+		}
+		if len(keys) != 0 {
+			path, err := pathMaker(dir, "idempotency.dump")
+			if err != nil {
+				return err
+			}
+			if err := exportIdempotencyRecords(ctx, keys, path); err != nil {
+				return err
+			}
+		}
+		if len(entries) != 0 {
+			path, err := pathMaker(dir, "ledger.dump")
+			if err != nil {
+				return err
+			}
+			if err := exportEntries(ctx, entries, path); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+//Import - import data from file. Any invalid line fails the import, use
+// ImportWithReport to skip them. Payment chunks written by HistoryToFiles
+// are imported in order of their manifest.
+func (s *Service) Import(dir string) (err error) {
+	return s.ImportContext(context.Background(), dir)
+}
+
+// ImportContext imports data like Import and stops when ctx is done, nothing
+// is saved then
+func (s *Service) ImportContext(ctx context.Context, dir string) error {
+	_, err := s.ImportWithReportContext(ctx, dir, ImportStrict)
+	return err
+}
+
 //ExportAccountHistory takes an accountID and returns all payments
 func (s *Service) ExportAccountHistory(accountID int64) ([]types.Payment, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
 
 	var payments []types.Payment
-	var account *types.Account
-
-	for _, acc := range s.accounts {
-		if accountID == acc.ID {
-			account = acc
-			break
-		}
-	}
+	account := s.findAccount(accountID)
 	if account == nil {
 		return nil, ErrAccountNotFound
 	}
 
-	for _, payment := range s.payments {
-		if accountID == payment.AccountID {
-			payments = append(payments, *payment)
-		}
+	for _, payment := range s.storage().PaymentsByAccount(accountID) {
+		payments = append(payments, *payment)
 	}
 	return payments, nil
 }
 
-//HistoryToFiles exports account history into files
-func (s *Service) HistoryToFiles(payments []types.Payment, dir string, records int) error {
+// AccountPaymentsInRange returns payments of the account created in [from, to).
+// Zero from or to leaves the range open from that side.
+func (s *Service) AccountPaymentsInRange(accountID int64, from time.Time, to time.Time) ([]types.Payment, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
 
-	var pmnts []*types.Payment
-	for _, payment := range payments {
-		pmnts = append(pmnts, &payment)
+	if s.findAccount(accountID) == nil {
+		return nil, ErrAccountNotFound
 	}
-	if len(payments) <= records && len(payments) > 0 {
-		path, err := pathMaker(dir, "payments.dump")
-		if err != nil {
-			return err
+	payments := []types.Payment{}
+	for _, payment := range s.storage().PaymentsByAccount(accountID) {
+		if inRange(payment.Created, from, to) {
+			payments = append(payments, *payment)
 		}
-		err = exportPayments(pmnts, path)
-	}
-	if len(payments) > records {
-		paymentsToExport := []*types.Payment{}
-		paymentsCnt := 1
-		for i, payment := range pmnts {
-			fileName := fmt.Sprintf("payments%v.dump", paymentsCnt)
-			path, err := pathMaker(dir, fileName)
-			paymentsToExport = append(paymentsToExport, payment)
-			if (i+1)%records == 0 && i != 0 {
-				err = exportPayments(paymentsToExport, path)
-				if err != nil {
-					return err
-				}
-				paymentsCnt++
-				paymentsToExport = []*types.Payment{}
-			}
-			if i+1 == len(pmnts) && (i+1)%records != 0 {
-				err = exportPayments(paymentsToExport, path)
-				if err != nil {
-					return err
-				}
-			}
+	}
+	return payments, nil
+}
+
+// PaymentsInRange returns payments of all accounts created in [from, to)
+func (s *Service) PaymentsInRange(from time.Time, to time.Time) []types.Payment {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
 
+	payments := []types.Payment{}
+	for _, payment := range s.storage().Payments() {
+		if inRange(payment.Created, from, to) {
+			payments = append(payments, *payment)
 		}
 	}
-	return nil
+	return payments
+}
+
+//HistoryToFiles exports account history into files
+func (s *Service) HistoryToFiles(payments []types.Payment, dir string, records int) error {
+	return s.HistoryToFilesAs(payments, dir, records, FormatDump)
+}
+
+// HistoryToFilesContext exports payments like HistoryToFiles and stops when
+// ctx is done
+func (s *Service) HistoryToFilesContext(ctx context.Context, payments []types.Payment, dir string, records int) error {
+	return s.HistoryToFilesAsContext(ctx, payments, dir, records, FormatDump)
 }
 
 //SumPayments calculates sum of payments amount with goroutines
 func (s *Service) SumPayments(goroutines int) types.Money {
-	if goroutines <= 1 || len(s.payments) == 1 {
-		return regularSum(s.payments)
-	}
-
-	wg := sync.WaitGroup{}
-	mu := sync.Mutex{}
-	total := types.Money(0)
+	sum, _ := s.SumPaymentsContext(context.Background(), goroutines)
+	return sum
+}
 
-	data := s.getPaymentsData(goroutines)
-	for _, pntSlice := range data {
-		wg.Add(1)
-		go concurrentSum(&total, pntSlice, &wg, &mu)
-	}
-	wg.Wait()
-	return total
+// SumPaymentsContext calculates sum of payments like SumPayments and stops
+// when ctx is done
+func (s *Service) SumPaymentsContext(ctx context.Context, goroutines int) (types.Money, error) {
+	stats, err := s.AggregatePaymentsContext(ctx, Parallel{Goroutines: goroutines}, nil)
+	return stats.Sum, err
 }
 
 //FilterPayments filters payments by accoundID executing function on goroutines
 func (s *Service) FilterPayments(accountID int64, goroutines int) ([]types.Payment, error) {
+	return s.FilterPaymentsContext(context.Background(), accountID, goroutines)
+}
 
-	var account *types.Account
-	for _, acc := range s.accounts {
-		if acc.ID == accountID {
-			account = acc
-		}
-	}
+// FilterPaymentsContext filters payments like FilterPayments and stops when
+// ctx is done
+func (s *Service) FilterPaymentsContext(ctx context.Context, accountID int64, goroutines int) ([]types.Payment, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	account := s.findAccount(accountID)
 	if account == nil {
 		return nil, ErrAccountNotFound
 	}
+	return filterPayments(ctx, s.storage().Payments(), goroutines, func(payment types.Payment) bool {
+		return payment.AccountID == accountID
+	})
+}
+
+//FilterPaymentsByFn function that returns payments that satisfies to the given function inside.
+// The function is called on a snapshot of payments without holding the lock,
+// so it may call methods of the service
+func (s *Service) FilterPaymentsByFn(filter func(payment types.Payment) bool, goroutines int) ([]types.Payment, error) {
+	return s.FilterPaymentsByFnContext(context.Background(), filter, goroutines)
+}
+
+// FilterPaymentsByFnContext filters payments like FilterPaymentsByFn and
+// stops when ctx is done
+func (s *Service) FilterPaymentsByFnContext(ctx context.Context, filter func(payment types.Payment) bool, goroutines int) ([]types.Payment, error) {
+	return filterPayments(ctx, s.snapshotPayments(), goroutines, filter)
+}
 
-	if goroutines <= 1 || len(s.payments) <= 1 {
-		var payments []types.Payment
-		for _, payment := range s.payments {
-			if payment.AccountID == accountID {
-				payments = append(payments, *payment)
+// SumPaymentsWithProgress sums payments split into parts of nearly equal size
+// and sends Progress as soon as each part is summed. Progress of the last
+// part has Done equal to Parts and Total of all payments. The channel is
+// closed after the last part or when ctx is cancelled, whichever is first.
+func (s *Service) SumPaymentsWithProgress(ctx context.Context, parts int) <-chan Progress {
+	chunks := splitPayments(s.snapshotPayments(), parts)
+	ch := make(chan Progress)
+	go func() {
+		defer close(ch)
+
+		next := make(chan int)
+		results := make(chan Progress, len(chunks))
+		workers := runtime.GOMAXPROCS(0)
+		if workers > len(chunks) {
+			workers = len(chunks)
+		}
+		for i := 0; i < workers; i++ {
+			go func() {
+				for part := range next {
+					results <- Progress{Part: part, Result: regularSum(chunks[part])}
+				}
+			}()
+		}
+		go func() {
+			defer close(next)
+			for part := range chunks {
+				select {
+				case next <- part:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+
+		total := types.Money(0)
+		for done := 1; done <= len(chunks); done++ {
+			var progress Progress
+			select {
+			case progress = <-results:
+			case <-ctx.Done():
+				return
+			}
+			total += progress.Result
+			progress.Done = done
+			progress.Parts = len(chunks)
+			progress.Total = total
+			select {
+			case ch <- progress:
+			case <-ctx.Done():
+				return
 			}
 		}
-		return payments, nil
-	}
+	}()
+	return ch
+}
 
-	mu := sync.Mutex{}
-	wg := sync.WaitGroup{}
-	payments := []types.Payment{}
-	dataToFilter := s.getPaymentsData(goroutines)
-	for _, item := range dataToFilter {
-		wg.Add(1)
-		go filterConcurrently(&payments, &wg, &mu, item, accountID)
+// Helpers
+
+// now returns current time of the service clock without monotonic reading,
+// so times survive export and import unchanged
+func (s *Service) now() time.Time {
+	if s.clock == nil {
+		return time.Now().UTC().Round(0)
 	}
-	wg.Wait()
-	return payments, nil
+	return s.clock().UTC().Round(0)
 }
 
-//FilterPaymentsByFn function that returns payments that satisfies to the given function inside
-func (s *Service) FilterPaymentsByFn(filter func(payment types.Payment) bool, goroutines int) ([]types.Payment, error) {
-
-	payments := []types.Payment{}
-	if goroutines <= 1 || len(s.payments) <= 1 {
-		for _, payment := range s.payments {
-			if filter(*payment) == true {
-				payments = append(payments, *payment)
-			}
+// storage returns repository of the service, zero value Service gets a
+// MemoryRepository on first use
+func (s *Service) storage() Repository {
+	s.init.Do(func() {
+		if s.repo == nil {
+			s.repo = NewMemoryRepository()
 		}
-		return payments, nil
+	})
+	return s.repo
+}
+
+// findAccount returns stored account, caller must hold the lock
+func (s *Service) findAccount(accountID int64) *types.Account {
+	account, err := s.storage().AccountByID(accountID)
+	if err != nil {
+		return nil
 	}
-	wg := sync.WaitGroup{}
-	mu := sync.Mutex{}
-	dataToFilter := s.getPaymentsData(goroutines)
-	for _, item := range dataToFilter {
-		wg.Add(1)
-		go filterFnConcurrently(filter, &wg, &mu, &payments, item)
+	return account
+}
+
+// findPayment returns stored payment, caller must hold the lock
+func (s *Service) findPayment(paymentID string) *types.Payment {
+	payment, err := s.storage().PaymentByID(paymentID)
+	if err != nil {
+		return nil
 	}
-	wg.Wait()
-	return payments, nil
+	return payment
 }
 
-//SumPaymentsWithProgress calculates sum of payments by dividing in to parts
-func (s *Service) SumPaymentsWithProgress() <-chan Progress{
-	pros := 100_000 
-	payments := s.payments
-	size := len(payments) / pros
-	ch := make(chan Progress)
-	defer close(ch)
-	for i := 0; i < pros; i++{
-		go func(ch chan<- Progress, data []*types.Payment,part int){
-			sum := Progress{}
-			for _, v := range data{
-				sum.Part = part
-				sum.Result += types.Money(v.Amount)
-			}
-			ch <-sum 
-		}(ch, payments[i*size:(i+1)*size],i)
-	} 
-	total := []Progress{}
-	for i := 0; i < pros; i++{
-		p := <- ch
-		total = append(total,p)
-	}
-	log.Print(total)
-	return ch
+func (s *Service) snapshotAccounts() []*types.Account {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.snapshotAccountsLocked()
 }
 
-// Helpers
+func (s *Service) snapshotPayments() []*types.Payment {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.snapshotPaymentsLocked()
+}
 
-func filterFnConcurrently(filter func(types.Payment) bool,
-	wg *sync.WaitGroup, mu *sync.Mutex, payments *[]types.Payment, data []*types.Payment) {
+func (s *Service) snapshotAccountsLocked() []*types.Account {
+	stored := s.storage().Accounts()
+	accounts := make([]*types.Account, len(stored))
+	for i, account := range stored {
+		accounts[i] = copyAccount(account)
+	}
+	return accounts
+}
 
-	mu.Lock()
-	for _, item := range data {
-		if filter(*item) == true {
-			*payments = append(*payments, *item)
-		}
+func (s *Service) snapshotPaymentsLocked() []*types.Payment {
+	stored := s.storage().Payments()
+	payments := make([]*types.Payment, len(stored))
+	for i, payment := range stored {
+		payments[i] = copyPayment(payment)
+	}
+	return payments
+}
+
+func (s *Service) snapshotFavoritesLocked() []*types.Favorite {
+	stored := s.storage().Favorites()
+	favorites := make([]*types.Favorite, len(stored))
+	for i, favorite := range stored {
+		favorites[i] = copyFavorite(favorite)
 	}
-	mu.Unlock()
-	wg.Done()
+	return favorites
 }
 
-func (s *Service) getPaymentsData(goroutines int) [][]*types.Payment {
-	prop := int(math.Ceil(float64(len(s.payments)) / float64(goroutines)))
-	index := 0
-	dataToFilter := make([][]*types.Payment, prop)
-	for i := 0; i < len(s.payments); i += goroutines {
-		end := int(math.Min(float64(i+goroutines), float64(len(s.payments))))
-		dataToFilter[index] = s.payments[i:end]
-		index++
+func (s *Service) snapshotIdempotencyRecordsLocked() []*IdempotencyRecord {
+	stored := s.storage().IdempotencyRecords()
+	records := make([]*IdempotencyRecord, len(stored))
+	for i, record := range stored {
+		copied := *record
+		records[i] = &copied
 	}
-	return dataToFilter
+	return records
+}
+
+func copyAccount(account *types.Account) *types.Account {
+	result := *account
+	return &result
 }
 
-func filterConcurrently(payments *[]types.Payment, wg *sync.WaitGroup, mu *sync.Mutex, data []*types.Payment, accountID int64) {
-	mu.Lock()
-	for _, info := range data {
-		if info.AccountID == accountID {
-			*payments = append(*payments, *info)
+func copyPayment(payment *types.Payment) *types.Payment {
+	result := *payment
+	return &result
+}
+
+func copyFavorite(favorite *types.Favorite) *types.Favorite {
+	result := *favorite
+	return &result
+}
+
+// splitPayments splits payments into parts which sizes differ by one at
+// most. There are no empty parts, except the only part of no payments.
+func splitPayments(payments []*types.Payment, parts int) [][]*types.Payment {
+	if parts > len(payments) {
+		parts = len(payments)
+	}
+	if parts < 1 {
+		parts = 1
+	}
+	chunks := make([][]*types.Payment, parts)
+	start := 0
+	for i := range chunks {
+		size := len(payments) / parts
+		if i < len(payments)%parts {
+			size++
 		}
+		chunks[i] = payments[start : start+size]
+		start += size
 	}
-	mu.Unlock()
-	wg.Done()
+	return chunks
 }
 
 func regularSum(payments []*types.Payment) types.Money {
@@ -589,231 +957,186 @@ func regularSum(payments []*types.Payment) types.Money {
 	return sum
 }
 
-func concurrentSum(total *types.Money, payments []*types.Payment, wg *sync.WaitGroup, mu *sync.Mutex) {
-	sum := types.Money(0)
-	mu.Lock()
-	for _, payment := range payments {
-		sum += payment.Amount
+func exportAccounts(ctx context.Context, accounts []*types.Account, dir string) (err error) {
+	w, err := createDump(ctx, dir)
+	if err != nil {
+		return err
 	}
-	*total += sum
-	mu.Unlock()
-	wg.Done()
-}
-
-func exportAccounts(accounts []*types.Account, dir string) (err error) {
-	data := ""
 	for _, account := range accounts {
 		id := strconv.FormatInt(int64(account.ID), 10)
 		balance := strconv.FormatInt(int64(account.Balance), 10)
 		phone := string(account.Phone)
-		data += id + ";" + phone + ";" + balance + "\n"
-	}
-	err = ioutil.WriteFile(dir, []byte(data), 0777)
-	if err != nil {
-		log.Print(err)
-		return ErrWorkingDirectoryNotFound
+		w.Record(id, phone, balance)
 	}
-	return nil
+	return w.Close()
 }
 
-func exportPayments(payments []*types.Payment, dir string) (err error) {
-	data := ""
+func exportPayments(ctx context.Context, payments []*types.Payment, dir string) (err error) {
+	w, err := createDump(ctx, dir)
+	if err != nil {
+		return err
+	}
 	for _, payment := range payments {
 		id := string(payment.ID)
 		accID := strconv.FormatInt(int64(payment.AccountID), 10)
 		amount := strconv.FormatInt(int64(payment.Amount), 10)
 		cat := string(payment.Category)
 		stat := string(payment.Status)
-		data += id + ";" + accID + ";" + amount + ";" + cat + ";" + stat + "\n"
-	}
-	err = ioutil.WriteFile(dir, []byte(data), 0777)
-	if err != nil {
-		log.Print(err)
-		return ErrWorkingDirectoryNotFound
+		created := formatTime(payment.Created)
+		updated := formatTime(payment.Updated)
+		w.Record(id, accID, amount, cat, stat, payment.LinkedID, created, updated)
 	}
-	return nil
+	return w.Close()
 }
 
-func exportFavorites(favorites []*types.Favorite, dir string) (err error) {
-	data := ""
+func exportFavorites(ctx context.Context, favorites []*types.Favorite, dir string) (err error) {
+	w, err := createDump(ctx, dir)
+	if err != nil {
+		return err
+	}
 	for _, favorite := range favorites {
 		id := string(favorite.ID)
 		accID := strconv.FormatInt(int64(favorite.AccountID), 10)
 		amount := strconv.FormatInt(int64(favorite.Amount), 10)
 		cat := string(favorite.Category)
 		name := string(favorite.Name)
-		data += id + ";" + accID + ";" + name + ";" + amount + ";" + cat + "\n"
+		w.Record(id, accID, name, amount, cat)
 	}
-	err = ioutil.WriteFile(dir, []byte(data), 0777)
-	if err != nil {
-		log.Print(err)
-		return ErrWorkingDirectoryNotFound
-	}
-	return nil
+	return w.Close()
 }
 
-func importAccounts(path string, s *Service) error {
-	dataRaw, err := s.getDataFromFile(path)
+func exportIdempotencyRecords(ctx context.Context, records []*IdempotencyRecord, dir string) (err error) {
+	w, err := createDump(ctx, dir)
 	if err != nil {
-		return ErrWorkingDirectoryNotFound
+		return err
 	}
-	data := string(dataRaw)
-	accounts, err := parseAccounts(data)
-	for _, account := range accounts {
-		if !isAccountInService(account, s) {
-			s.accounts = append(s.accounts, account)
-			if account.ID >= s.nextAccountID {
-				s.nextAccountID = account.ID + 1
-			}
-		}
+	for _, record := range records {
+		w.Record(record.Key, record.Request, record.PaymentID)
 	}
-	return nil
+	return w.Close()
 }
 
-func importPayments(path string, s *Service) error {
-	dataRaw, err := s.getDataFromFile(path)
+// parseAccount parses fields of accounts.dump line
+func parseAccount(info []string) (*types.Account, *ImportIssue) {
+	if len(info) != 3 {
+		return nil, &ImportIssue{Reason: fmt.Sprintf("got %v fields, want 3", len(info))}
+	}
+	ID, err := strconv.ParseInt(info[0], 10, 64)
 	if err != nil {
-		return ErrWorkingDirectoryNotFound
+		return nil, invalidNumber("id", info[0])
 	}
-	data := string(dataRaw)
-	payments, err := parsePayments(data)
-	for _, payment := range payments {
-		if !isPaymentInService(payment, s) {
-			s.payments = append(s.payments, payment)
-		}
+	balance, err := strconv.ParseInt(info[2], 10, 64)
+	if err != nil {
+		return nil, invalidNumber("balance", info[2])
 	}
-	return nil
+	return &types.Account{
+		ID:      ID,
+		Phone:   types.Phone(info[1]),
+		Balance: types.Money(balance),
+	}, nil
 }
 
-func importFavorites(path string, s *Service) error {
-	dataRaw, err := s.getDataFromFile(path)
+// parsePayment parses fields of payments.dump line, linked ID and times are
+// optional for dumps written by older versions
+func parsePayment(info []string) (*types.Payment, *ImportIssue) {
+	if len(info) < 5 || len(info) > 8 {
+		return nil, &ImportIssue{Reason: fmt.Sprintf("got %v fields, want 5 to 8", len(info))}
+	}
+	accountID, err := strconv.ParseInt(info[1], 10, 64)
 	if err != nil {
-		return ErrWorkingDirectoryNotFound
+		return nil, invalidNumber("account_id", info[1])
 	}
-	data := string(dataRaw)
-	favorites, err := parseFavorites(data)
-	for _, favorite := range favorites {
-		if !isFavoriteInService(favorite, s) {
-			s.favorites = append(s.favorites, favorite)
+	amount, err := strconv.ParseInt(info[2], 10, 64)
+	if err != nil {
+		return nil, invalidNumber("amount", info[2])
+	}
+	payment := &types.Payment{
+		ID:        info[0],
+		AccountID: accountID,
+		Amount:    types.Money(amount),
+		Category:  types.PaymentCategory(info[3]),
+		Status:    types.PaymentStatus(info[4]),
+	}
+	if len(info) > 5 {
+		payment.LinkedID = info[5]
+	}
+	if len(info) > 6 {
+		payment.Created, err = parseTime(info[6])
+		if err != nil {
+			return nil, &ImportIssue{Field: "created", Reason: fmt.Sprintf("invalid time %q", info[6])}
 		}
 	}
-	return nil
-}
-
-func isAccountInService(info *types.Account, s *Service) bool {
-	for _, account := range s.accounts {
-		if reflect.DeepEqual(account, info) {
-			return true
+	if len(info) > 7 {
+		payment.Updated, err = parseTime(info[7])
+		if err != nil {
+			return nil, &ImportIssue{Field: "updated", Reason: fmt.Sprintf("invalid time %q", info[7])}
 		}
 	}
-	return false
+	return payment, nil
 }
 
-func isPaymentInService(info *types.Payment, s *Service) bool {
-	for _, payment := range s.payments {
-		if reflect.DeepEqual(payment, info) {
-			return true
-		}
+// parseFavorite parses fields of favorites.dump line
+func parseFavorite(info []string) (*types.Favorite, *ImportIssue) {
+	if len(info) != 5 {
+		return nil, &ImportIssue{Reason: fmt.Sprintf("got %v fields, want 5", len(info))}
 	}
-	return false
+	accountID, err := strconv.ParseInt(info[1], 10, 64)
+	if err != nil {
+		return nil, invalidNumber("account_id", info[1])
+	}
+	amount, err := strconv.ParseInt(info[3], 10, 64)
+	if err != nil {
+		return nil, invalidNumber("amount", info[3])
+	}
+	return &types.Favorite{
+		ID:        info[0],
+		AccountID: accountID,
+		Name:      info[2],
+		Amount:    types.Money(amount),
+		Category:  types.PaymentCategory(info[4]),
+	}, nil
 }
 
-func isFavoriteInService(info *types.Favorite, s *Service) bool {
-	for _, favorite := range s.favorites {
-		if reflect.DeepEqual(favorite, info) {
-			return true
-		}
+// parseIdempotencyRecord parses fields of idempotency.dump line
+func parseIdempotencyRecord(info []string) (*IdempotencyRecord, *ImportIssue) {
+	if len(info) != 3 {
+		return nil, &ImportIssue{Reason: fmt.Sprintf("got %v fields, want 3", len(info))}
 	}
-	return false
+	return &IdempotencyRecord{
+		Key:       info[0],
+		Request:   info[1],
+		PaymentID: info[2],
+	}, nil
 }
 
-func parseAccounts(data string) ([]*types.Account, error) {
-	var accounts []*types.Account
-	dataRaw := strings.Split(data, "\n")
-	for _, item := range dataRaw {
-		info := strings.Split(item, ";")
-		if len(strings.Trim(item, " ")) == 0 {
-			break
-		}
-		ID, err := strconv.ParseInt(info[0], 10, 64)
-		if err != nil {
-			return nil, ErrInParsing
-		}
-		phone := types.Phone(info[1])
-		balance, err := strconv.ParseInt(info[2], 10, 64)
-		if err != nil {
-			return nil, ErrInParsing
-		}
-		account := &types.Account{
-			ID:      ID,
-			Phone:   phone,
-			Balance: types.Money(balance),
-		}
-		accounts = append(accounts, account)
+func invalidNumber(field string, value string) *ImportIssue {
+	return &ImportIssue{Field: field, Reason: fmt.Sprintf("invalid number %q", value)}
+}
+
+// inRange checks that t is in [from, to), zero bounds are open
+func inRange(t time.Time, from time.Time, to time.Time) bool {
+	if !from.IsZero() && t.Before(from) {
+		return false
 	}
-	return accounts, nil
+	if !to.IsZero() && !t.Before(to) {
+		return false
+	}
+	return true
 }
 
-func parsePayments(data string) ([]*types.Payment, error) {
-	var payments []*types.Payment
-	dataRaw := strings.Split(data, "\n")
-	for _, item := range dataRaw {
-		info := strings.Split(item, ";")
-		if len(strings.Trim(item, " ")) == 0 {
-			break
-		}
-		ID := string(info[0])
-		accountID, err := strconv.ParseInt(info[1], 10, 64)
-		if err != nil {
-			return nil, ErrInParsing
-		}
-		amount, err := strconv.ParseInt(info[2], 10, 64)
-		if err != nil {
-			return nil, ErrInParsing
-		}
-		category := string(info[3])
-		status := types.PaymentStatus(info[4])
-		payment := &types.Payment{
-			ID:        ID,
-			AccountID: accountID,
-			Amount:    types.Money(amount),
-			Category:  types.PaymentCategory(category),
-			Status:    status,
-		}
-		payments = append(payments, payment)
+// formatTime formats time for dumps, zero time is an empty string
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
 	}
-	return payments, nil
+	return t.Format(time.RFC3339Nano)
 }
 
-func parseFavorites(data string) ([]*types.Favorite, error) {
-	var favorites []*types.Favorite
-	dataRaw := strings.Split(data, "\n")
-	for _, item := range dataRaw {
-		info := strings.Split(item, ";")
-		if len(strings.Trim(item, " ")) == 0 {
-			break
-		}
-		ID := string(info[0])
-		accountID, err := strconv.ParseInt(info[1], 10, 64)
-		if err != nil {
-			return nil, ErrInParsing
-		}
-		name := string(info[2])
-		amount, err := strconv.ParseInt(info[3], 10, 64)
-		if err != nil {
-			return nil, ErrInParsing
-		}
-		category := string(info[4])
-		favorite := &types.Favorite{
-			ID:        ID,
-			AccountID: accountID,
-			Name:      name,
-			Amount:    types.Money(amount),
-			Category:  types.PaymentCategory(category),
-		}
-		favorites = append(favorites, favorite)
+func parseTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
 	}
-	return favorites, nil
+	return time.Parse(time.RFC3339Nano, value)
 }
 
 func pathMaker(dir string, fileName string) (string, error) {
@@ -837,37 +1160,3 @@ func (s *Service) fileExist(path string) bool {
 
 	return !info.IsDir()
 }
-
-func (s *Service) getDataFromFile(path string) (string, error) {
-	file, err := os.Open(path)
-	if err != nil {
-		log.Println(err)
-		return "", err
-	}
-
-	defer func() {
-		if err := file.Close(); err != nil {
-			log.Println(err)
-		}
-	}()
-
-	content := make([]byte, 0)
-	buf := make([]byte, 4096)
-
-	for {
-		read, err := file.Read(buf)
-		if err == io.EOF {
-			break
-		}
-
-		if err != nil {
-			log.Println(err)
-			return "", err
-		}
-
-		content = append(content, buf[:read]...)
-	}
-
-	data := string(content)
-	return data, nil
-}
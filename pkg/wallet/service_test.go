@@ -1,10 +1,19 @@
 package wallet
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io/ioutil"
 	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/ilhom0258/wallet/pkg/ledger"
 	"github.com/ilhom0258/wallet/pkg/types"
 )
 
@@ -277,6 +286,2118 @@ func BenchmarkService_FilterPaymentsByFn_success(b *testing.B) {
 	}
 }
 
+func TestService_concurrentAccess(t *testing.T) {
+	s := newTestService()
+	const accounts = 10
+	const deposit = types.Money(1_000_000)
+	ids := make([]int64, accounts)
+	for i := range ids {
+		account, err := s.RegisterAccount(types.Phone(fmt.Sprintf("+99200000%04d", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = s.Deposit(account.ID, deposit); err != nil {
+			t.Fatal(err)
+		}
+		ids[i] = account.ID
+	}
+
+	dir := t.TempDir()
+	wg := sync.WaitGroup{}
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			accountID := ids[i%accounts]
+			payment, err := s.Pay(accountID, 100, "auto")
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if i%2 == 0 {
+				if err := s.Reject(payment.ID); err != nil {
+					t.Error(err)
+				}
+			} else if _, err := s.Repeat(payment.ID); err != nil {
+				t.Error(err)
+			}
+			if err := s.Deposit(accountID, 10); err != nil {
+				t.Error(err)
+			}
+			if _, err := s.FindAccountByID(accountID); err != nil {
+				t.Error(err)
+			}
+			if _, err := s.ExportAccountHistory(accountID); err != nil {
+				t.Error(err)
+			}
+			if _, err := s.FilterPayments(accountID, 3); err != nil {
+				t.Error(err)
+			}
+			s.SumPayments(4)
+			s.FilterPaymentsByFn(func(payment types.Payment) bool {
+				return payment.Status == types.PaymentStatusFail
+			}, 3)
+			if err := s.Export(dir); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	total := types.Money(0)
+	for _, id := range ids {
+		account, err := s.FindAccountByID(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		total += account.Balance
+	}
+	spent := types.Money(0)
+	payments, _ := s.FilterPaymentsByFn(func(payment types.Payment) bool {
+		return payment.Status != types.PaymentStatusFail
+	}, 1)
+	for _, payment := range payments {
+		spent += payment.Amount
+	}
+	want := accounts*deposit + 50*10
+	if total+spent != want {
+		t.Errorf("balances and payments = %v, want %v", total+spent, want)
+	}
+}
+
+func TestService_FindAccountByID_returnsCopy(t *testing.T) {
+	s := newTestService()
+	account, err := s.RegisterAccount("+992000000001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	account.Balance = 100
+	found, err := s.FindAccountByID(account.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found.Balance != 0 {
+		t.Errorf("balance = %v, want 0", found.Balance)
+	}
+}
+
+func TestService_Transfer_success(t *testing.T) {
+	s := newTestService()
+	from, _, err := s.addAccount(defaultTestAccount)
+	if err != nil {
+		t.Fatal(err)
+	}
+	to, err := s.RegisterAccount("+992000000002")
+	if err != nil {
+		t.Fatal(err)
+	}
+	before, _ := s.FindAccountByID(from.ID)
+
+	debit, err := s.Transfer(from.ID, to.ID, 500)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if debit.AccountID != from.ID || debit.Category != types.PaymentCategoryTransferOut {
+		t.Errorf("debit = %v", debit)
+	}
+	credit, err := s.storage().PaymentByID(debit.LinkedID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if credit.AccountID != to.ID || credit.LinkedID != debit.ID || credit.Category != types.PaymentCategoryTransferIn {
+		t.Errorf("credit = %v", credit)
+	}
+	after, _ := s.FindAccountByID(from.ID)
+	if after.Balance != before.Balance-500 {
+		t.Errorf("from balance = %v, want %v", after.Balance, before.Balance-500)
+	}
+	received, _ := s.FindAccountByID(to.ID)
+	if received.Balance != 500 {
+		t.Errorf("to balance = %v, want 500", received.Balance)
+	}
+	if err := s.Reject(debit.ID); err != ErrTransferPayment {
+		t.Errorf("reject err = %v, want %v", err, ErrTransferPayment)
+	}
+}
+
+func TestService_Transfer_errors(t *testing.T) {
+	s := newTestService()
+	from, err := s.RegisterAccount("+992000000001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	to, err := s.RegisterAccount("+992000000002")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Deposit(from.ID, 100); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		from, to int64
+		amount   types.Money
+		want     error
+	}{
+		{from.ID, to.ID, 0, ErrAmountMustBePositive},
+		{from.ID, to.ID, 101, ErrNotEnoughBalance},
+		{from.ID, 100, 10, ErrAccountNotFound},
+		{100, to.ID, 10, ErrAccountNotFound},
+		{from.ID, from.ID, 10, ErrTransferToSameAccount},
+	}
+	for _, test := range tests {
+		if _, err := s.Transfer(test.from, test.to, test.amount); err != test.want {
+			t.Errorf("Transfer(%v, %v, %v) err = %v, want %v", test.from, test.to, test.amount, err, test.want)
+		}
+	}
+	account, _ := s.FindAccountByID(from.ID)
+	if account.Balance != 100 {
+		t.Errorf("balance = %v, want 100", account.Balance)
+	}
+}
+
+func TestService_TransferByPhone_success(t *testing.T) {
+	s := newTestService()
+	from, err := s.RegisterAccount("+992000000001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	to, err := s.RegisterAccount("+992000000002")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Deposit(from.ID, 100); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.TransferByPhone(from.ID, "+992000000003", 10); err != ErrAccountNotFound {
+		t.Errorf("err = %v, want %v", err, ErrAccountNotFound)
+	}
+	if _, err := s.TransferByPhone(from.ID, to.Phone, 100); err != nil {
+		t.Fatal(err)
+	}
+	account, _ := s.FindAccountByID(to.ID)
+	if account.Balance != 100 {
+		t.Errorf("balance = %v, want 100", account.Balance)
+	}
+}
+
+func TestService_Reject_twice(t *testing.T) {
+	s := newTestService()
+	account, payments, err := s.addAccount(defaultTestAccount)
+	if err != nil {
+		t.Fatal(err)
+	}
+	before, _ := s.FindAccountByID(account.ID)
+	if err := s.Reject(payments[0].ID); err != nil {
+		t.Fatal(err)
+	}
+	err = s.Reject(payments[0].ID)
+	if !errors.Is(err, ErrInvalidTransition) {
+		t.Errorf("err = %v, want %v", err, ErrInvalidTransition)
+	}
+	after, _ := s.FindAccountByID(account.ID)
+	if after.Balance != before.Balance+payments[0].Amount {
+		t.Errorf("balance = %v, want %v", after.Balance, before.Balance+payments[0].Amount)
+	}
+}
+
+func TestService_Complete_success(t *testing.T) {
+	s := newTestService()
+	_, payments, err := s.addAccount(defaultTestAccount)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payment := payments[0]
+	err = s.Complete(payment.ID)
+	var transitionErr *TransitionError
+	if !errors.As(err, &transitionErr) || transitionErr.Status != types.PaymentStatusInProgress {
+		t.Fatalf("err = %v, want transition error", err)
+	}
+	if err := s.Confirm(payment.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Complete(payment.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Reject(payment.ID); !errors.Is(err, ErrInvalidTransition) {
+		t.Errorf("err = %v, want %v", err, ErrInvalidTransition)
+	}
+	if err := s.Confirm("unknown"); err != ErrPaymentNotFound {
+		t.Errorf("err = %v, want %v", err, ErrPaymentNotFound)
+	}
+
+	history, err := s.PaymentHistory(payment.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []types.PaymentStatus{
+		types.PaymentStatusInProgress,
+		types.PaymentStatusConfirmed,
+		types.PaymentStatusOk,
+	}
+	if len(history) != len(want) {
+		t.Fatalf("history = %v, want %v transitions", history, len(want))
+	}
+	for i, transition := range history {
+		if transition.To != want[i] {
+			t.Errorf("transition %v to = %v, want %v", i, transition.To, want[i])
+		}
+	}
+	if history[0].Event != types.PaymentEventCreate || history[2].From != types.PaymentStatusConfirmed {
+		t.Errorf("history = %v", history)
+	}
+}
+
+func TestService_PayWithKey_retry(t *testing.T) {
+	s := newTestService()
+	account, payments, err := s.addAccount(defaultTestAccount)
+	if err != nil {
+		t.Fatal(err)
+	}
+	before, _ := s.FindAccountByID(account.ID)
+	first, err := s.PayWithKey("key-1", account.ID, 100, "auto")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := s.PayWithKey("key-1", account.ID, 100, "auto")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.ID != second.ID {
+		t.Errorf("retry returned payment %v, want %v", second.ID, first.ID)
+	}
+	after, _ := s.FindAccountByID(account.ID)
+	if after.Balance != before.Balance-100 {
+		t.Errorf("balance = %v, want %v", after.Balance, before.Balance-100)
+	}
+	if _, err := s.PayWithKey("key-1", account.ID, 200, "auto"); err != ErrIdempotencyKeyReused {
+		t.Errorf("err = %v, want %v", err, ErrIdempotencyKeyReused)
+	}
+
+	if err := s.DepositWithKey("key-2", account.ID, 50); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.DepositWithKey("key-2", account.ID, 50); err != nil {
+		t.Fatal(err)
+	}
+	repeated, err := s.RepeatWithKey("key-3", payments[0].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := s.RepeatWithKey("key-3", payments[0].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if repeated.ID != again.ID {
+		t.Errorf("retry returned payment %v, want %v", again.ID, repeated.ID)
+	}
+	favorite, err := s.FavoritePayment(payments[0].ID, "auto")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fromFavorite, err := s.PayFromFavoriteWithKey("key-4", favorite.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err = s.PayFromFavoriteWithKey("key-4", favorite.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fromFavorite.ID != again.ID {
+		t.Errorf("retry returned payment %v, want %v", again.ID, fromFavorite.ID)
+	}
+	after, _ = s.FindAccountByID(account.ID)
+	want := before.Balance - 100 + 50 - payments[0].Amount - favorite.Amount
+	if after.Balance != want {
+		t.Errorf("balance = %v, want %v", after.Balance, want)
+	}
+}
+
+func TestService_PayWithKey_exportImport(t *testing.T) {
+	s := newTestService()
+	account, _, err := s.addAccount(defaultTestAccount)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payment, err := s.PayWithKey("key-1", account.ID, 100, "auto")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	if err := s.Export(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	imported := newTestService()
+	if err := imported.Import(dir); err != nil {
+		t.Fatal(err)
+	}
+	retried, err := imported.PayWithKey("key-1", account.ID, 100, "auto")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if retried.ID != payment.ID {
+		t.Errorf("retry returned payment %v, want %v", retried.ID, payment.ID)
+	}
+}
+
+func TestService_VerifyLedger_success(t *testing.T) {
+	s := newTestService()
+	account, payments, err := s.addAccount(defaultTestAccount)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := s.RegisterAccount("+992000000002")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Reject(payments[0].ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Transfer(account.ID, other.ID, 1_000); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.VerifyLedger(); err != nil {
+		t.Fatal(err)
+	}
+
+	balance, err := s.LedgerBalance(other.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if balance != 1_000 {
+		t.Errorf("ledger balance = %v, want 1000", balance)
+	}
+	entries, err := s.LedgerEntries(account.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// deposit, payments, refund and transfer
+	if len(entries) != len(payments)+3 {
+		t.Errorf("entries = %v, want %v", len(entries), len(payments)+3)
+	}
+	if entries[0].Kind != ledger.KindDeposit || entries[len(entries)-1].Kind != ledger.KindTransfer {
+		t.Errorf("entries = %v", entries)
+	}
+
+	dir := t.TempDir()
+	if err := s.Export(dir); err != nil {
+		t.Fatal(err)
+	}
+	imported := newTestService()
+	if err := imported.Import(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := imported.VerifyLedger(); err != nil {
+		t.Error(err)
+	}
+	want, _ := s.FindAccountByID(account.ID)
+	balance, err = imported.LedgerBalance(account.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if balance != want.Balance {
+		t.Errorf("imported ledger balance = %v, want %v", balance, want.Balance)
+	}
+}
+
+func TestService_VerifyLedger_mismatch(t *testing.T) {
+	s := newTestService()
+	account, _, err := s.addAccount(defaultTestAccount)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tampered := copyAccount(account)
+	tampered.Balance++
+	if err := s.storage().Save(Changes{Accounts: []*types.Account{tampered}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.VerifyLedger(); !errors.Is(err, ErrLedgerMismatch) {
+		t.Errorf("err = %v, want %v", err, ErrLedgerMismatch)
+	}
+}
+
+func TestService_PaymentsInRange_success(t *testing.T) {
+	now := time.Date(2020, time.October, 1, 12, 0, 0, 0, time.UTC)
+	clock := func() time.Time {
+		return now
+	}
+	s := &testService{Service: NewService(NewMemoryRepository(), WithClock(clock))}
+	account, err := s.RegisterAccount("+992000000001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := s.RegisterAccount("+992000000002")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Deposit(account.ID, 1_000); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Deposit(other.ID, 1_000); err != nil {
+		t.Fatal(err)
+	}
+	september, err := s.Pay(account.ID, 10, "auto")
+	if err != nil {
+		t.Fatal(err)
+	}
+	now = now.AddDate(0, 1, 0)
+	october, err := s.Pay(account.ID, 20, "auto")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Pay(other.ID, 30, "auto"); err != nil {
+		t.Fatal(err)
+	}
+	now = now.Add(time.Hour)
+	if err := s.Reject(september.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	from := time.Date(2020, time.November, 1, 0, 0, 0, 0, time.UTC)
+	to := from.AddDate(0, 1, 0)
+	payments, err := s.AccountPaymentsInRange(account.ID, from, to)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(payments) != 1 || payments[0].ID != october.ID {
+		t.Errorf("payments = %v, want %v", payments, october.ID)
+	}
+	if all := s.PaymentsInRange(from, to); len(all) != 2 {
+		t.Errorf("payments = %v, want 2", len(all))
+	}
+	if all := s.PaymentsInRange(time.Time{}, time.Time{}); len(all) != 3 {
+		t.Errorf("payments = %v, want 3", len(all))
+	}
+	if _, err := s.AccountPaymentsInRange(100, from, to); err != ErrAccountNotFound {
+		t.Errorf("err = %v, want %v", err, ErrAccountNotFound)
+	}
+
+	dir := t.TempDir()
+	if err := s.Export(dir); err != nil {
+		t.Fatal(err)
+	}
+	imported := newTestService()
+	if err := imported.Import(dir); err != nil {
+		t.Fatal(err)
+	}
+	payment, err := imported.storage().PaymentByID(september.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !payment.Created.Equal(september.Created) || !payment.Updated.Equal(now) {
+		t.Errorf("imported payment = %v, want created %v, updated %v", payment, september.Created, now)
+	}
+}
+
+func TestService_ExportAs_json(t *testing.T) {
+	s := newTestService()
+	account, payments, err := s.addAccount(defaultTestAccount)
+	if err != nil {
+		t.Fatal(err)
+	}
+	favorite, err := s.FavoritePayment(payments[0].ID, "home;\nmobile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.PayWithKey("key-1", account.ID, 100, "auto"); err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	if err := s.ExportAs(dir, FormatJSON); err != nil {
+		t.Fatal(err)
+	}
+
+	imported := newTestService()
+	if err := imported.ImportAs(dir, FormatJSON); err != nil {
+		t.Fatal(err)
+	}
+	if err := imported.ImportAs(dir, FormatJSON); err != nil {
+		t.Fatal(err)
+	}
+	got, err := imported.FindAccountByID(account.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, _ := s.FindAccountByID(account.ID)
+	if *got != *want {
+		t.Errorf("account = %v, want %v", got, want)
+	}
+	if len(imported.snapshotPayments()) != len(s.snapshotPayments()) {
+		t.Errorf("payments = %v, want %v", len(imported.snapshotPayments()), len(s.snapshotPayments()))
+	}
+	favorites, err := imported.AccountFavorites(account.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(favorites) != 1 || favorites[0] != *favorite {
+		t.Errorf("favorites = %v, want %v", favorites, favorite)
+	}
+	if err := imported.VerifyLedger(); err != nil {
+		t.Error(err)
+	}
+
+	if err := s.ExportAs(dir, "xml"); err != ErrUnknownFormat {
+		t.Errorf("ExportAs() error = %v, want %v", err, ErrUnknownFormat)
+	}
+}
+
+func TestService_ExportAs_csv(t *testing.T) {
+	s := newTestService()
+	account, _, err := s.addAccount(defaultTestAccount)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payment, err := s.Pay(account.ID, 100, `food; "cafe", lunch`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.FavoritePayment(payment.ID, "lunch\nat work"); err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	if err := s.ExportAs(dir, FormatCSV); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(dir, currentLink, "payments.csv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(data), "id,account_id,amount,category,status,linked_id,created,updated\n") {
+		t.Errorf("payments.csv has no header: %q", data)
+	}
+
+	imported := newTestService()
+	if err := imported.ImportAs(dir, FormatCSV); err != nil {
+		t.Fatal(err)
+	}
+	got, err := imported.FindPaymentByID(payment.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *got != *payment {
+		t.Errorf("payment = %v, want %v", got, payment)
+	}
+	favorites, err := imported.AccountFavorites(account.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(favorites) != 1 || favorites[0].Name != "lunch\nat work" {
+		t.Errorf("favorites = %v, want one named %q", favorites, "lunch\nat work")
+	}
+	if err := imported.VerifyLedger(); err != nil {
+		t.Error(err)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(dir, currentLink, "accounts.csv"), []byte("id;phone;balance\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if err := newTestService().ImportAs(dir, FormatCSV); err != ErrInParsing {
+		t.Errorf("ImportAs() error = %v, want %v", err, ErrInParsing)
+	}
+}
+
+func TestService_HistoryToFilesAs_parts(t *testing.T) {
+	s := newTestService()
+	account, _, err := s.addAccount(defaultTestAccount)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payments, err := s.ExportAccountHistory(account.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	if err := s.HistoryToFilesAs(payments, dir, 4, FormatCSV); err != nil {
+		t.Fatal(err)
+	}
+	var exported []*types.Payment
+	for part := 1; part <= 3; part++ {
+		err := readCSV(context.Background(), filepath.Join(dir, fmt.Sprintf("payments%v.csv", part)), paymentsHeader, func(row []string) error {
+			payment, err := parsePaymentRow(row)
+			exported = append(exported, payment)
+			return err
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(exported) != len(payments) {
+		t.Fatalf("exported %v payments, want %v", len(exported), len(payments))
+	}
+	for i, payment := range exported {
+		if *payment != payments[i] {
+			t.Errorf("payment %v = %v, want %v", i, payment, payments[i])
+		}
+	}
+}
+
+func TestService_Import_verifiesDumpHeader(t *testing.T) {
+	s := newTestService()
+	if _, _, err := s.addAccount(defaultTestAccount); err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	if err := s.Export(dir); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, currentLink, "payments.dump")
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.SplitAfter(string(data), "\n")
+	if !strings.HasPrefix(lines[0], "#wallet-dump version=2 records=11 sha256=") {
+		t.Fatalf("header = %q", lines[0])
+	}
+
+	truncated := strings.Join(lines[:len(lines)-2], "")
+	if err := ioutil.WriteFile(path, []byte(truncated), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if err := newTestService().Import(dir); err != ErrCorruptedDump {
+		t.Errorf("Import() of truncated dump error = %v, want %v", err, ErrCorruptedDump)
+	}
+
+	future := strings.Replace(string(data), "version=2", "version=3", 1)
+	if err := ioutil.WriteFile(path, []byte(future), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if err := newTestService().Import(dir); !errors.Is(err, ErrUnsupportedDumpVersion) {
+		t.Errorf("Import() of version 3 error = %v, want %v", err, ErrUnsupportedDumpVersion)
+	}
+
+	headerless := strings.Join(lines[1:], "")
+	if err := ioutil.WriteFile(path, []byte(headerless), 0666); err != nil {
+		t.Fatal(err)
+	}
+	imported := newTestService()
+	if err := imported.Import(dir); err != nil {
+		t.Fatal(err)
+	}
+	if got := len(imported.snapshotPayments()); got != 11 {
+		t.Errorf("imported %v payments, want 11", got)
+	}
+	if err := imported.Export(dir); err != nil {
+		t.Fatal(err)
+	}
+	upgraded, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(upgraded) != string(data) {
+		t.Errorf("upgraded dump = %q, want %q", upgraded, data)
+	}
+}
+
+func TestService_Export_atomic(t *testing.T) {
+	s := newTestService()
+	if _, _, err := s.addAccount(defaultTestAccount); err != nil {
+		t.Fatal(err)
+	}
+	dir := filepath.Join(t.TempDir(), "data")
+	if err := os.Mkdir(dir, 0777); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"precious.txt", "favorites.dump"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte("keep me"), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	entries := func(dir string) []string {
+		t.Helper()
+		infos, err := ioutil.ReadDir(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		names := []string{}
+		for _, info := range infos {
+			name := info.Name()
+			if strings.HasPrefix(name, generationPrefix) {
+				name = generationPrefix
+			}
+			names = append(names, name)
+		}
+		return names
+	}
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := s.Export(dir); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if names, want := fmt.Sprint(entries(dir)), "[.export- .export- current favorites.dump precious.txt]"; names != want {
+		t.Errorf("exports left %v, want %v", names, want)
+	}
+	for _, name := range []string{"precious.txt", "favorites.dump"} {
+		if data, err := ioutil.ReadFile(filepath.Join(dir, name)); err != nil || string(data) != "keep me" {
+			t.Errorf("%v = %q, %v, want it kept", name, data, err)
+		}
+	}
+	if names, want := fmt.Sprint(entries(filepath.Join(dir, currentLink))), "[accounts.dump ledger.dump payments.dump]"; names != want {
+		t.Errorf("current export has %v, want %v", names, want)
+	}
+
+	current, err := os.Readlink(filepath.Join(dir, currentLink))
+	if err != nil {
+		t.Fatal(err)
+	}
+	failure := errors.New("disk is full")
+	err = exportAtomically(context.Background(), dir, dumpFiles, func(staging string) error {
+		if err := ioutil.WriteFile(filepath.Join(staging, "accounts.dump"), []byte("garbage"), 0666); err != nil {
+			t.Fatal(err)
+		}
+		return failure
+	})
+	if err != failure {
+		t.Errorf("exportAtomically() error = %v, want %v", err, failure)
+	}
+	if link, err := os.Readlink(filepath.Join(dir, currentLink)); err != nil || link != current {
+		t.Errorf("failed export switched current to %v, %v, want %v", link, err, current)
+	}
+	imported := newTestService()
+	if err := imported.Import(dir); err != nil {
+		t.Fatal(err)
+	}
+	if got := len(imported.snapshotPayments()); got != 11 {
+		t.Errorf("imported %v payments, want 11", got)
+	}
+
+	if err := s.ExportAs(dir, FormatJSON); err != nil {
+		t.Fatal(err)
+	}
+	if names, want := fmt.Sprint(entries(filepath.Join(dir, currentLink))), "[accounts.dump accounts.json ledger.dump ledger.jsonl payments.dump payments.jsonl]"; names != want {
+		t.Errorf("export in other format has %v, want %v", names, want)
+	}
+
+	history, err := s.ExportAccountHistory(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.HistoryToFiles(history, dir, 4); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Export(dir); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "payments3.dump")); err != nil {
+		t.Errorf("export removed history chunk: %v", err)
+	}
+
+	if err := os.Remove(filepath.Join(dir, currentLink)); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(dir, currentLink), 0777); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Export(dir); !errors.Is(err, ErrNotExportDir) {
+		t.Errorf("Export() into directory with own current error = %v, want %v", err, ErrNotExportDir)
+	}
+}
+
+func TestService_Export_generations(t *testing.T) {
+	small := newBenchmarkService(1, 10)
+	large := newBenchmarkService(3, 300)
+	dir := t.TempDir()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 50; i++ {
+			s := small
+			if i%2 == 1 {
+				s = large
+			}
+			if err := s.Export(dir); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	for reads := 0; ; reads++ {
+		select {
+		case <-done:
+			if reads == 0 {
+				t.Error("no reads")
+			}
+			return
+		default:
+		}
+		export, err := openExportDir(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		d, err := (&Service{}).readDumps(context.Background(), export, &ImportReport{})
+		export.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := fmt.Sprint(len(d.accounts), len(d.payments))
+		if got != "0 0" && got != "1 10" && got != "3 300" {
+			t.Fatalf("read %v accounts and payments, want a whole export", got)
+		}
+	}
+}
+
+func TestService_ImportWithReport(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"accounts.dump": "1;+992000000001;1000\n",
+		"payments.dump": "p1;1;100;auto;INPROGRESS\n" +
+			"p2;1;abc;auto;INPROGRESS\n" +
+			"\n" +
+			"p3;1\n" +
+			"p4;1;200;food;OK;;;\n",
+	}
+	for name, data := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(data), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	strict := newTestService()
+	_, err := strict.ImportWithReport(dir, ImportStrict)
+	if !errors.Is(err, ErrInParsing) {
+		t.Errorf("ImportWithReport() error = %v, want %v", err, ErrInParsing)
+	}
+	if len(strict.snapshotAccounts()) != 0 {
+		t.Errorf("strict import saved accounts")
+	}
+	if err := strict.Import(dir); !errors.Is(err, ErrInParsing) {
+		t.Errorf("Import() error = %v, want %v", err, ErrInParsing)
+	}
+
+	lenient := newTestService()
+	report, err := lenient.ImportWithReport(dir, ImportLenient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []ImportIssue{
+		{File: "payments.dump", Line: 2, Field: "amount", Reason: `invalid number "abc"`},
+		{File: "payments.dump", Line: 4, Reason: "got 2 fields, want 5 to 8"},
+	}
+	if len(report.Issues) != len(want) {
+		t.Fatalf("issues = %v, want %v", report.Issues, want)
+	}
+	for i := range want {
+		if report.Issues[i] != want[i] {
+			t.Errorf("issue %v = %v, want %v", i, report.Issues[i], want[i])
+		}
+	}
+	if report.Accepted() != 3 || report.Rejected() != 2 {
+		t.Errorf("accepted %v, rejected %v, want 3 and 2", report.Accepted(), report.Rejected())
+	}
+	if got := len(lenient.snapshotPayments()); got != 2 {
+		t.Errorf("imported %v payments, want 2", got)
+	}
+}
+
+func TestService_ValidateImport(t *testing.T) {
+	s := newTestService()
+	if _, err := s.RegisterAccount("+992000000009"); err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	files := map[string]string{
+		"accounts.dump": "1;+992000000009;100\n" +
+			"2;+992000000002;-5\n" +
+			"3;+992000000002;0\n" +
+			"3;+992000000003;0\n",
+		"payments.dump": "p1;1;100;auto;OK\n" +
+			"p1;2;100;auto;DONE\n" +
+			"p2;7;100;auto;FAIL\n" +
+			"p3;x;100;auto;FAIL\n",
+		"favorites.dump": "f1;8;home;100;auto\n",
+	}
+	for name, data := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(data), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	issues, err := s.ValidateImport(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		`payments.dump:4: account_id: invalid number "x"`,
+		`accounts.dump:2: balance: negative balance -5`,
+		`accounts.dump:3: phone: phone +992000000002 is used by account 2`,
+		`accounts.dump:4: id: duplicate account 3`,
+		`payments.dump:2: id: duplicate payment p1`,
+		`payments.dump:2: status: unknown status "DONE"`,
+		`payments.dump:3: account_id: unknown account 7`,
+		`favorites.dump:1: account_id: unknown account 8`,
+	}
+	if len(issues) != len(want) {
+		t.Fatalf("issues = %v, want %v", issues, want)
+	}
+	for i := range want {
+		if issues[i].String() != want[i] {
+			t.Errorf("issue %v = %v, want %v", i, issues[i], want[i])
+		}
+	}
+	if len(s.snapshotAccounts()) != 1 || len(s.snapshotPayments()) != 0 {
+		t.Errorf("ValidateImport() changed the service")
+	}
+}
+
+func TestService_ImportWithOptions_policies(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"accounts.dump": "1;+992000000001;500\n",
+		"payments.dump": "p1;1;100;auto;OK;;2020-09-01T10:00:00Z;2020-09-02T10:00:00Z\n" +
+			"p2;1;100;auto;OK;;2020-09-01T10:00:00Z;2020-09-02T10:00:00Z\n",
+	}
+	for name, data := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(data), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stored := func() *testService {
+		t.Helper()
+		s := newTestService()
+		files := map[string]string{
+			"accounts.dump": "1;+992000000001;1000\n",
+			"payments.dump": "p1;1;100;auto;INPROGRESS;;2020-09-01T10:00:00Z;2020-09-01T10:00:00Z\n" +
+				"p2;1;100;auto;FAIL;;2020-09-01T10:00:00Z;2020-09-03T10:00:00Z\n",
+		}
+		storedDir := t.TempDir()
+		for name, data := range files {
+			if err := ioutil.WriteFile(filepath.Join(storedDir, name), []byte(data), 0666); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := s.Import(storedDir); err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+
+	tests := []struct {
+		policy  MergePolicy
+		balance types.Money
+		p1      types.PaymentStatus
+		p2      types.PaymentStatus
+		err     error
+	}{
+		{MergeSkip, 1000, types.PaymentStatusInProgress, types.PaymentStatusFail, nil},
+		// Failed payment was refunded, it can't become OK again
+		{MergeOverwrite, 1000, types.PaymentStatusInProgress, types.PaymentStatusFail, ErrImportConflict},
+		{MergeKeepNewest, 500, types.PaymentStatusOk, types.PaymentStatusFail, nil},
+	}
+	for _, test := range tests {
+		s := stored()
+		options := ImportOptions{Accounts: test.policy, Payments: test.policy, Favorites: test.policy}
+		if _, err := s.ImportWithOptions(dir, options); !errors.Is(err, test.err) {
+			t.Fatalf("policy %v: error = %v, want %v", test.policy, err, test.err)
+		}
+		if accounts := s.snapshotAccounts(); len(accounts) != 1 || accounts[0].Balance != test.balance {
+			t.Errorf("policy %v: accounts = %v, want one with balance %v", test.policy, accounts, test.balance)
+		}
+		p1, p2 := s.findPayment("p1"), s.findPayment("p2")
+		if p1.Status != test.p1 || p2.Status != test.p2 {
+			t.Errorf("policy %v: statuses = %v, %v, want %v, %v", test.policy, p1.Status, p2.Status, test.p1, test.p2)
+		}
+		if err := s.VerifyLedger(); err != nil {
+			t.Errorf("policy %v: %v", test.policy, err)
+		}
+	}
+
+	s := stored()
+	_, err := s.ImportWithOptions(dir, ImportOptions{Payments: MergeFail})
+	if !errors.Is(err, ErrImportConflict) {
+		t.Errorf("MergeFail error = %v, want %v", err, ErrImportConflict)
+	}
+	if p1 := s.findPayment("p1"); p1.Status != types.PaymentStatusInProgress {
+		t.Errorf("failed import changed payment to %v", p1.Status)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "accounts.dump"), []byte("2;+992000000001;500\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.ImportWithOptions(dir, ImportOptions{Accounts: MergeOverwrite}); !errors.Is(err, ErrImportConflict) {
+		t.Errorf("phone conflict error = %v, want %v", err, ErrImportConflict)
+	}
+	if _, err := s.ImportWithOptions(dir, ImportOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if accounts := s.snapshotAccounts(); len(accounts) != 1 {
+		t.Errorf("accounts = %v, want account with the phone skipped", accounts)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "accounts.dump"), []byte("2;+992000000002;10\n3;+992000000002;20\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	for _, policy := range []MergePolicy{MergeFail, MergeOverwrite} {
+		if _, err := s.ImportWithOptions(dir, ImportOptions{Accounts: policy}); !errors.Is(err, ErrImportConflict) {
+			t.Errorf("phone used twice in dump with policy %v error = %v, want %v", policy, err, ErrImportConflict)
+		}
+	}
+	if _, err := s.ImportWithOptions(dir, ImportOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	owner, err := s.storage().AccountByPhone("+992000000002")
+	if err != nil || owner.ID != 2 {
+		t.Errorf("phone belongs to %v, %v, want account 2", owner, err)
+	}
+	if _, err := s.FindAccountByID(3); err != ErrAccountNotFound {
+		t.Errorf("FindAccountByID(3) error = %v, want account with used phone skipped", err)
+	}
+}
+
+func TestService_Import_chunks(t *testing.T) {
+	s := newTestService()
+	account, _, err := s.addAccount(defaultTestAccount)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payments, err := s.ExportAccountHistory(account.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	if err := s.HistoryToFiles(payments, dir, 4); err != nil {
+		t.Fatal(err)
+	}
+	imported := newTestService()
+	if err := imported.Import(dir); err != nil {
+		t.Fatal(err)
+	}
+	got := imported.snapshotPayments()
+	if len(got) != len(payments) {
+		t.Fatalf("imported %v payments, want %v", len(got), len(payments))
+	}
+	for i := range payments {
+		if *got[i] != payments[i] {
+			t.Errorf("payment %v = %v, want %v", i, got[i], payments[i])
+		}
+	}
+
+	last := filepath.Join(dir, "payments3.dump")
+	data, err := ioutil.ReadFile(last)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(last); err != nil {
+		t.Fatal(err)
+	}
+	if err := newTestService().Import(dir); !errors.Is(err, ErrMissingChunk) {
+		t.Errorf("Import() without last chunk error = %v, want %v", err, ErrMissingChunk)
+	}
+	if err := ioutil.WriteFile(last, data, 0666); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(dir, "payments2.dump")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(dir, "payments.manifest.json")); err != nil {
+		t.Fatal(err)
+	}
+	if err := newTestService().Import(dir); !errors.Is(err, ErrMissingChunk) {
+		t.Errorf("Import() without manifest and second chunk error = %v, want %v", err, ErrMissingChunk)
+	}
+
+	// Shorter history replaces chunks of the longer one
+	if err := s.HistoryToFiles(payments, dir, 2); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.HistoryToFiles(payments, dir, 4); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "payments4.dump")); !os.IsNotExist(err) {
+		t.Errorf("stale payments4.dump is left: %v", err)
+	}
+	if err := s.HistoryToFiles(payments[:2], dir, 0); err != nil {
+		t.Fatal(err)
+	}
+	imported = newTestService()
+	if err := imported.Import(dir); err != nil {
+		t.Fatal(err)
+	}
+	if got := len(imported.snapshotPayments()); got != 2 {
+		t.Errorf("imported %v payments after single file export, want 2", got)
+	}
+
+	// Chunks replace the single file
+	if err := s.HistoryToFiles(payments[2:7], dir, 2); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "payments.dump")); !os.IsNotExist(err) {
+		t.Errorf("stale payments.dump is left: %v", err)
+	}
+	imported = newTestService()
+	if err := imported.Import(dir); err != nil {
+		t.Fatal(err)
+	}
+	if got := len(imported.snapshotPayments()); got != 5 {
+		t.Errorf("imported %v payments after chunked export, want 5", got)
+	}
+}
+
+func BenchmarkService_FindAccountByID(b *testing.B) {
+	for _, count := range []int{1_000, 10_000, 100_000} {
+		s := newBenchmarkService(count, 0)
+		b.Run(fmt.Sprint(count), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if _, err := s.FindAccountByID(int64(i%count + 1)); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkService_ExportAccountHistory(b *testing.B) {
+	for _, count := range []int{1_000, 10_000, 100_000} {
+		s := newBenchmarkService(100, count)
+		b.Run(fmt.Sprint(count), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				payments, err := s.ExportAccountHistory(int64(i%100 + 1))
+				if err != nil {
+					b.Fatal(err)
+				}
+				if len(payments) != count/100 {
+					b.Fatalf("history has %v payments, want %v", len(payments), count/100)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkService_Import(b *testing.B) {
+	for _, count := range []int{1_000, 10_000, 100_000} {
+		dir := filepath.Join(b.TempDir(), "data")
+		if err := newBenchmarkService(count/10, count).Export(dir); err != nil {
+			b.Fatal(err)
+		}
+		b.Run(fmt.Sprint(count), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				s := newTestService()
+				if err := s.Import(dir); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestService_QueryPayments_filters(t *testing.T) {
+	now := time.Date(2020, time.October, 1, 12, 0, 0, 0, time.UTC)
+	clock := func() time.Time {
+		now = now.Add(time.Minute)
+		return now
+	}
+	s := &testService{Service: NewService(NewMemoryRepository(), WithClock(clock))}
+	account, err := s.RegisterAccount("+992000000001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := s.RegisterAccount("+992000000002")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Deposit(account.ID, 10_000); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Deposit(other.ID, 10_000); err != nil {
+		t.Fatal(err)
+	}
+	var payments []*types.Payment
+	for i, category := range []types.PaymentCategory{"auto", "food", "auto", "auto", "food"} {
+		payment, err := s.Pay(account.ID, types.Money(100*(i+1)), category)
+		if err != nil {
+			t.Fatal(err)
+		}
+		payments = append(payments, payment)
+	}
+	if _, err := s.Pay(other.ID, 300, "auto"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Reject(payments[2].ID); err != nil {
+		t.Fatal(err)
+	}
+
+	page, err := s.QueryPayments().Account(account.ID).Category("auto").
+		Status(types.PaymentStatusInProgress).Amount(100, 400).
+		SortBy(SortByAmount, true).Fetch()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if page.Total != 2 || len(page.Payments) != 2 || page.NextCursor != "" {
+		t.Fatalf("page = %v, want 2 payments", page)
+	}
+	if page.Payments[0].ID != payments[3].ID || page.Payments[1].ID != payments[0].ID {
+		t.Errorf("payments = %v, want %v and %v", page.Payments, payments[3].ID, payments[0].ID)
+	}
+
+	page, err = s.QueryPayments().Created(payments[1].Created, payments[4].Created).Fetch()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if page.Total != 3 || page.Payments[0].ID != payments[1].ID || page.Payments[2].ID != payments[3].ID {
+		t.Errorf("payments created in range = %v, want payments 1 to 3", page.Payments)
+	}
+
+	if _, err := s.QueryPayments().Account(3).Fetch(); err != ErrAccountNotFound {
+		t.Errorf("err = %v, want %v", err, ErrAccountNotFound)
+	}
+}
+
+func TestService_QueryPayments_pages(t *testing.T) {
+	s := newBenchmarkService(3, 25)
+	seen := map[string]bool{}
+	cursor := ""
+	pages := 0
+	for {
+		page, err := s.QueryPayments().SortBy(SortByAmount, false).Limit(10).After(cursor).Fetch()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if page.Total != 25 {
+			t.Errorf("total = %v, want 25", page.Total)
+		}
+		for i, payment := range page.Payments {
+			if seen[payment.ID] {
+				t.Errorf("payment %v is on two pages", payment.ID)
+			}
+			seen[payment.ID] = true
+			if i > 0 && payment.Amount < page.Payments[i-1].Amount {
+				t.Errorf("payment %v isn't sorted by amount", payment.ID)
+			}
+		}
+		pages++
+		if page.NextCursor == "" {
+			break
+		}
+		cursor = page.NextCursor
+	}
+	if pages != 3 || len(seen) != 25 {
+		t.Errorf("read %v payments on %v pages, want 25 on 3", len(seen), pages)
+	}
+
+	page, err := s.QueryPayments().Offset(20).Limit(10).Fetch()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Payments) != 5 || page.NextCursor != "" {
+		t.Errorf("last page has %v payments, cursor %q, want 5 and none", len(page.Payments), page.NextCursor)
+	}
+
+	if _, err := s.QueryPayments().SortBy(SortByCreated, true).After(cursor).Fetch(); err != ErrInvalidCursor {
+		t.Errorf("cursor of another order err = %v, want %v", err, ErrInvalidCursor)
+	}
+	if _, err := s.QueryPayments().After("???").Fetch(); err != ErrInvalidCursor {
+		t.Errorf("broken cursor err = %v, want %v", err, ErrInvalidCursor)
+	}
+}
+
+func TestService_SumPaymentsWithProgress(t *testing.T) {
+	s := newTestService()
+	if _, _, err := s.addAccount(defaultTestAccount); err != nil {
+		t.Fatal(err)
+	}
+	parts := map[int]bool{}
+	var last Progress
+	for progress := range s.SumPaymentsWithProgress(context.Background(), 4) {
+		if parts[progress.Part] {
+			t.Errorf("part %v is reported twice", progress.Part)
+		}
+		parts[progress.Part] = true
+		if progress.Done != len(parts) || progress.Parts != 4 {
+			t.Errorf("progress = %+v, want %v of 4 done", progress, len(parts))
+		}
+		last = progress
+	}
+	if len(parts) != 4 || last.Total != 11_000_00 {
+		t.Errorf("summed %v parts to %v, want 4 parts and %v", len(parts), last.Total, types.Money(11_000_00))
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	ch := s.SumPaymentsWithProgress(ctx, 11)
+	<-ch
+	cancel()
+	for range ch {
+	}
+	if err := ctx.Err(); err != context.Canceled {
+		t.Errorf("err = %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestSplitPayments(t *testing.T) {
+	payments := benchmarkPayments(10)
+	for _, parts := range []int{-1, 1, 3, 4, 10, 20} {
+		chunks := splitPayments(payments, parts)
+		count := 0
+		for _, chunk := range chunks {
+			if len(chunk) == 0 {
+				t.Errorf("%v parts: empty part", parts)
+			}
+			count += len(chunk)
+		}
+		if count != len(payments) {
+			t.Errorf("%v parts: split %v payments, want %v", parts, count, len(payments))
+		}
+	}
+	if chunks := splitPayments(nil, 4); len(chunks) != 1 || len(chunks[0]) != 0 {
+		t.Errorf("parts of no payments = %v, want a single empty part", chunks)
+	}
+}
+
+func TestService_AggregatePayments(t *testing.T) {
+	s := newBenchmarkService(3, 100)
+	want := PaymentStats{Count: 100, Sum: 5050, Min: 1, Max: 100}
+	for _, goroutines := range []int{0, 1, 3, 8, 200} {
+		for _, ordered := range []bool{false, true} {
+			parallel := Parallel{Goroutines: goroutines, Ordered: ordered}
+			if stats := s.AggregatePayments(parallel, nil); stats != want {
+				t.Errorf("%+v: stats = %+v, want %+v", parallel, stats, want)
+			}
+		}
+	}
+
+	stats := s.AggregatePayments(Parallel{Goroutines: 4}, func(payment types.Payment) bool {
+		return payment.AccountID == 2
+	})
+	if stats.Count != 33 || stats.Min != 2 || stats.Max != 98 {
+		t.Errorf("stats of account 2 = %+v, want 33 payments from 2 to 98", stats)
+	}
+	if stats := s.AggregatePayments(Parallel{Goroutines: 4}, func(types.Payment) bool { return false }); stats != (PaymentStats{}) {
+		t.Errorf("stats of no payments = %+v, want zero", stats)
+	}
+
+	groups := s.GroupPayments(Parallel{Goroutines: 4}, func(payment types.Payment) string {
+		return fmt.Sprint(payment.AccountID)
+	})
+	wantGroups := map[string]PaymentStats{
+		"1": {Count: 34, Sum: 1717, Min: 1, Max: 100},
+		"2": {Count: 33, Sum: 1650, Min: 2, Max: 98},
+		"3": {Count: 33, Sum: 1683, Min: 3, Max: 99},
+	}
+	if len(groups) != len(wantGroups) {
+		t.Errorf("groups = %+v, want %+v", groups, wantGroups)
+	}
+	for key, want := range wantGroups {
+		if groups[key] != want {
+			t.Errorf("group %v = %+v, want %+v", key, groups[key], want)
+		}
+	}
+}
+
+func TestService_FilterPaymentsByFn_ordered(t *testing.T) {
+	s := newBenchmarkService(3, 100)
+	payments, err := s.FilterPaymentsByFn(func(payment types.Payment) bool {
+		return payment.AccountID != 2
+	}, 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(payments) != 67 {
+		t.Fatalf("filtered %v payments, want 67", len(payments))
+	}
+	for i := 1; i < len(payments); i++ {
+		if payments[i].Amount <= payments[i-1].Amount {
+			t.Fatalf("payment %v is out of order", payments[i].ID)
+		}
+	}
+}
+
+func TestService_AggregatePayments_reentrant(t *testing.T) {
+	s := newBenchmarkService(3, 100)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		// Callbacks run without the lock, so they may change the service
+		deposit := func(payment types.Payment) bool {
+			if payment.Amount == 1 {
+				if err := s.Deposit(payment.AccountID, 1); err != nil {
+					t.Error(err)
+				}
+			}
+			return true
+		}
+		if payments, err := s.FilterPaymentsByFn(deposit, 4); err != nil || len(payments) != 100 {
+			t.Errorf("FilterPaymentsByFn() = %v payments, %v", len(payments), err)
+		}
+		if stats := s.AggregatePayments(Parallel{Goroutines: 4}, deposit); stats.Count != 100 {
+			t.Errorf("AggregatePayments() count = %v, want 100", stats.Count)
+		}
+		s.GroupPayments(Parallel{Goroutines: 4}, func(payment types.Payment) string {
+			deposit(payment)
+			return ""
+		})
+		s.ReducePayments(Parallel{}, Reducer{
+			Zero: func() interface{} { return nil },
+			Fold: func(acc interface{}, payment types.Payment) interface{} {
+				deposit(payment)
+				return acc
+			},
+			Merge: func(acc interface{}, part interface{}) interface{} { return acc },
+		})
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("callbacks calling the service deadlocked")
+	}
+}
+
+func BenchmarkService_AggregatePayments(b *testing.B) {
+	s := newBenchmarkService(100, 1_000_000)
+	for _, goroutines := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprint(goroutines), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if stats := s.AggregatePayments(Parallel{Goroutines: goroutines}, nil); stats.Count != 1_000_000 {
+					b.Fatalf("count = %v, want 1000000", stats.Count)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkService_GroupPayments(b *testing.B) {
+	s := newBenchmarkService(100, 1_000_000)
+	key := func(payment types.Payment) string {
+		return string(payment.Category)
+	}
+	for _, goroutines := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprint(goroutines), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				s.GroupPayments(Parallel{Goroutines: goroutines, Ordered: true}, key)
+			}
+		})
+	}
+}
+
+func TestService_Context_canceled(t *testing.T) {
+	s := newBenchmarkService(10, 3*checkEvery)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	dir := filepath.Join(t.TempDir(), "data")
+	if err := s.ExportContext(ctx, dir); err != context.Canceled {
+		t.Errorf("ExportContext() error = %v, want %v", err, context.Canceled)
+	}
+	if _, err := os.Lstat(dir); !os.IsNotExist(err) {
+		t.Errorf("canceled export left %v: %v", dir, err)
+	}
+	for _, format := range []Format{FormatJSON, FormatCSV} {
+		if err := s.ExportAsContext(ctx, dir, format); err != context.Canceled {
+			t.Errorf("ExportAsContext(%v) error = %v, want %v", format, err, context.Canceled)
+		}
+	}
+	payments, err := s.FilterPaymentsByFnContext(ctx, func(types.Payment) bool { return true }, 4)
+	if err != context.Canceled || payments != nil {
+		t.Errorf("FilterPaymentsByFnContext() = %v payments, %v, want %v", len(payments), err, context.Canceled)
+	}
+	if _, err := s.SumPaymentsContext(ctx, 1); err != context.Canceled {
+		t.Errorf("SumPaymentsContext() error = %v, want %v", err, context.Canceled)
+	}
+	history, err := s.ExportAccountHistory(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.HistoryToFilesContext(ctx, history, t.TempDir(), 0); err != context.Canceled {
+		t.Errorf("HistoryToFilesContext() error = %v, want %v", err, context.Canceled)
+	}
+
+	if err := s.Export(dir); err != nil {
+		t.Fatal(err)
+	}
+	target := newTestService()
+	if err := target.ImportContext(ctx, dir); err != context.Canceled {
+		t.Errorf("ImportContext() error = %v, want %v", err, context.Canceled)
+	}
+	if _, err := target.ValidateImportContext(ctx, dir); err != context.Canceled {
+		t.Errorf("ValidateImportContext() error = %v, want %v", err, context.Canceled)
+	}
+	if accounts := target.snapshotAccounts(); len(accounts) != 0 {
+		t.Errorf("canceled import saved %v accounts", len(accounts))
+	}
+	if err := target.ImportContext(context.Background(), dir); err != nil {
+		t.Fatal(err)
+	}
+	if payments := target.snapshotPayments(); len(payments) != 3*checkEvery {
+		t.Errorf("imported %v payments, want %v", len(payments), 3*checkEvery)
+	}
+}
+
+func TestService_SpendingReport(t *testing.T) {
+	now := time.Date(2020, time.October, 1, 12, 0, 0, 0, time.UTC)
+	clock := func() time.Time {
+		return now
+	}
+	s := &testService{Service: NewService(NewMemoryRepository(), WithClock(clock))}
+	account, err := s.RegisterAccount("+992000000001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := s.RegisterAccount("+992000000002")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Deposit(account.ID, 10_000); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Deposit(other.ID, 10_000); err != nil {
+		t.Fatal(err)
+	}
+	pay := func(accountID int64, amount types.Money, category types.PaymentCategory) *types.Payment {
+		payment, err := s.Pay(accountID, amount, category)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return payment
+	}
+	pay(account.ID, 100, "auto")
+	failed := pay(account.ID, 1_000, "auto")
+	if err := s.Reject(failed.ID); err != nil {
+		t.Fatal(err)
+	}
+	now = now.AddDate(0, 0, 1)
+	pay(account.ID, 300, "food")
+	pay(other.ID, 40, "food")
+	if _, err := s.Transfer(account.ID, other.ID, 50); err != nil {
+		t.Fatal(err)
+	}
+	now = now.AddDate(0, 0, 4)
+	pay(account.ID, 200, "auto")
+
+	week := func(day int) time.Time {
+		return time.Date(2020, time.September, day, 0, 0, 0, 0, time.UTC)
+	}
+	tests := []struct {
+		name    string
+		options ReportOptions
+		want    []SpendingRow
+	}{
+		{"account", ReportOptions{AccountID: account.ID}, []SpendingRow{
+			{Category: "auto", AccountID: account.ID, Total: 300, Count: 2, Average: 150},
+			{Category: "food", AccountID: account.ID, Total: 300, Count: 1, Average: 300},
+			{Category: types.PaymentCategoryTransferOut, AccountID: account.ID, Total: 50, Count: 1, Average: 50},
+		}},
+		{"all accounts", ReportOptions{}, []SpendingRow{
+			{Category: "auto", Total: 300, Count: 2, Average: 150},
+			{Category: "food", Total: 340, Count: 2, Average: 170},
+			{Category: types.PaymentCategoryTransferOut, Total: 50, Count: 1, Average: 50},
+		}},
+		{"by account", ReportOptions{ByAccount: true, From: week(28).AddDate(0, 0, 7)}, []SpendingRow{
+			{Category: "auto", AccountID: account.ID, Total: 200, Count: 1, Average: 200},
+		}},
+		{"weeks", ReportOptions{AccountID: account.ID, Period: PeriodWeek}, []SpendingRow{
+			{Category: "auto", AccountID: account.ID, Start: week(28), Total: 100, Count: 1, Average: 100},
+			{Category: "food", AccountID: account.ID, Start: week(28), Total: 300, Count: 1, Average: 300},
+			{Category: types.PaymentCategoryTransferOut, AccountID: account.ID, Start: week(28), Total: 50, Count: 1, Average: 50},
+			{Category: "auto", AccountID: account.ID, Start: week(28).AddDate(0, 0, 7), Total: 200, Count: 1, Average: 200},
+		}},
+		{"failed", ReportOptions{Statuses: []types.PaymentStatus{types.PaymentStatusFail}, Period: PeriodMonth}, []SpendingRow{
+			{Category: "auto", Start: week(1).AddDate(0, 1, 0), Total: 1_000, Count: 1, Average: 1_000},
+		}},
+	}
+	for _, test := range tests {
+		rows, err := s.SpendingReport(test.options)
+		if err != nil {
+			t.Fatalf("%v: %v", test.name, err)
+		}
+		if len(rows) != len(test.want) {
+			t.Errorf("%v: rows = %+v, want %+v", test.name, rows, test.want)
+			continue
+		}
+		for i := range rows {
+			if rows[i] != test.want[i] {
+				t.Errorf("%v: row %v = %+v, want %+v", test.name, i, rows[i], test.want[i])
+			}
+		}
+	}
+
+	if _, err := s.SpendingReport(ReportOptions{Period: PeriodMonth + 1}); err != ErrUnknownPeriod {
+		t.Errorf("err = %v, want %v", err, ErrUnknownPeriod)
+	}
+	if _, err := s.SpendingReport(ReportOptions{AccountID: 3}); err != ErrAccountNotFound {
+		t.Errorf("err = %v, want %v", err, ErrAccountNotFound)
+	}
+}
+
+func TestService_MonthlyStatement(t *testing.T) {
+	now := time.Date(2020, time.September, 30, 12, 0, 0, 0, time.UTC)
+	clock := func() time.Time {
+		return now
+	}
+	s := &testService{Service: NewService(NewMemoryRepository(), WithClock(clock))}
+	account, err := s.RegisterAccount("+992000000001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := s.RegisterAccount("+992000000002")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Deposit(account.ID, 10_000); err != nil {
+		t.Fatal(err)
+	}
+	now = now.AddDate(0, 0, 1)
+	rejected, err := s.Pay(account.ID, 1_000, "auto")
+	if err != nil {
+		t.Fatal(err)
+	}
+	now = now.AddDate(0, 0, 1)
+	if err := s.Reject(rejected.ID); err != nil {
+		t.Fatal(err)
+	}
+	now = now.AddDate(0, 0, 1)
+	if _, err := s.Transfer(account.ID, other.ID, 500); err != nil {
+		t.Fatal(err)
+	}
+	now = now.AddDate(0, 0, 2)
+	if _, err := s.Pay(account.ID, 2_000, "food"); err != nil {
+		t.Fatal(err)
+	}
+	now = now.AddDate(0, 1, 0)
+	if _, err := s.Pay(account.ID, 100, "food"); err != nil {
+		t.Fatal(err)
+	}
+
+	statement, err := s.MonthlyStatement(account.ID, 2020, time.October)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if statement.Opening != 10_000 || statement.Closing != 7_500 {
+		t.Errorf("balances = %v - %v, want 10000 - 7500", statement.Opening, statement.Closing)
+	}
+	want := []struct {
+		description string
+		amount      types.Money
+		balance     types.Money
+	}{
+		{"payment: auto", -1_000, 9_000},
+		{"refund: auto", 1_000, 10_000},
+		{"transfer to account 2", -500, 9_500},
+		{"payment: food", -2_000, 7_500},
+	}
+	if len(statement.Lines) != len(want) {
+		t.Fatalf("lines = %+v, want %v lines", statement.Lines, len(want))
+	}
+	for i, line := range statement.Lines {
+		if line.Description != want[i].description || line.Amount != want[i].amount || line.Balance != want[i].balance {
+			t.Errorf("line %v = %+v, want %+v", i, line, want[i])
+		}
+	}
+	if line := statement.Lines[1]; line.PaymentID != rejected.ID || line.Status != types.PaymentStatusFail {
+		t.Errorf("refund line = %+v, want payment %v in FAIL", line, rejected.ID)
+	}
+
+	text := &strings.Builder{}
+	if err := statement.WriteText(text); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(text.String(), "transfer to account 2  -5.00") || !strings.Contains(text.String(), "Closing balance") {
+		t.Errorf("text statement:\n%v", text)
+	}
+	table := &strings.Builder{}
+	if err := statement.WriteCSV(table); err != nil {
+		t.Fatal(err)
+	}
+	if rows := strings.Count(table.String(), "\n"); rows != 7 {
+		t.Errorf("CSV statement has %v rows, want 7:\n%v", rows, table)
+	}
+	page := &strings.Builder{}
+	if err := statement.WriteHTML(page); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(page.String(), "<td>payment: food</td><td>-20.00</td><td>75.00</td>") {
+		t.Errorf("HTML statement:\n%v", page)
+	}
+
+	if _, err := s.MonthlyStatement(3, 2020, time.October); err != ErrAccountNotFound {
+		t.Errorf("err = %v, want %v", err, ErrAccountNotFound)
+	}
+}
+
+func TestService_MonthlyStatement_roundTrip(t *testing.T) {
+	now := time.Date(2021, time.January, 10, 12, 0, 0, 0, time.UTC)
+	clock := func() time.Time {
+		return now
+	}
+	s := &testService{Service: NewService(NewMemoryRepository(), WithClock(clock))}
+	account, err := s.RegisterAccount("+992000000001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := s.RegisterAccount("+992000000002")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Deposit(account.ID, 100); err != nil {
+		t.Fatal(err)
+	}
+	now = now.AddDate(0, 0, 1)
+	if _, err := s.Pay(account.ID, 20, "auto"); err != nil {
+		t.Fatal(err)
+	}
+	now = now.AddDate(0, 0, 1)
+	if _, err := s.Transfer(account.ID, other.ID, 5); err != nil {
+		t.Fatal(err)
+	}
+	want, err := s.MonthlyStatement(account.ID, 2021, time.January)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, format := range []Format{FormatDump, FormatJSON, FormatCSV} {
+		dir := t.TempDir()
+		if err := s.ExportAs(dir, format); err != nil {
+			t.Fatal(err)
+		}
+		imported := NewService(NewMemoryRepository(), WithClock(func() time.Time {
+			return time.Date(2021, time.March, 1, 0, 0, 0, 0, time.UTC)
+		}))
+		if err := imported.ImportAs(dir, format); err != nil {
+			t.Fatal(err)
+		}
+		if err := imported.VerifyLedger(); err != nil {
+			t.Errorf("%v: VerifyLedger() error = %v", format, err)
+		}
+		got, err := imported.MonthlyStatement(account.ID, 2021, time.January)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Opening != 0 || got.Closing != 75 || len(got.Lines) != len(want.Lines) {
+			t.Errorf("%v: statement %v - %v with %v lines, want 0 - 75 with %v lines",
+				format, got.Opening, got.Closing, len(got.Lines), len(want.Lines))
+			continue
+		}
+		for i := range got.Lines {
+			line := got.Lines[i]
+			if line.At.Equal(want.Lines[i].At) {
+				line.At = want.Lines[i].At
+			}
+			if line != want.Lines[i] {
+				t.Errorf("%v: line %v = %v, want %v", format, i, line, want.Lines[i])
+			}
+		}
+
+		// Importing the same history again changes nothing
+		if err := imported.ImportAs(dir, format); err != nil {
+			t.Fatal(err)
+		}
+		entries, err := imported.LedgerEntries(account.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != len(want.Lines) {
+			t.Errorf("%v: %v ledger entries after second import, want %v", format, len(entries), len(want.Lines))
+		}
+	}
+}
+
+func TestService_ImportAs_chunks(t *testing.T) {
+	s := newTestService()
+	account, _, err := s.addAccount(defaultTestAccount)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payments, err := s.ExportAccountHistory(account.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, format := range []Format{FormatJSON, FormatCSV} {
+		dir := t.TempDir()
+		if err := s.HistoryToFilesAs(payments, dir, 4, format); err != nil {
+			t.Fatal(err)
+		}
+		imported := newTestService()
+		if err := imported.ImportAs(dir, format); err != nil {
+			t.Fatal(err)
+		}
+		got := imported.snapshotPayments()
+		if len(got) != len(payments) {
+			t.Fatalf("%v: imported %v payments, want %v", format, len(got), len(payments))
+		}
+		for i := range payments {
+			if !got[i].Created.Equal(payments[i].Created) || got[i].ID != payments[i].ID || got[i].Amount != payments[i].Amount {
+				t.Errorf("%v: payment %v = %v, want %v", format, i, got[i], payments[i])
+			}
+		}
+
+		last := filepath.Join(dir, "payments3"+paymentExtensions[format])
+		if err := os.Remove(last); err != nil {
+			t.Fatal(err)
+		}
+		if err := newTestService().ImportAs(dir, format); !errors.Is(err, ErrMissingChunk) {
+			t.Errorf("%v: ImportAs() without last chunk error = %v, want %v", format, err, ErrMissingChunk)
+		}
+	}
+}
+
+func TestService_ImportFromFile_roundTrip(t *testing.T) {
+	s := newBenchmarkService(2*checkEvery+1, 0)
+	path := filepath.Join(t.TempDir(), "export.txt")
+	if err := s.ExportToFile(path); err != nil {
+		t.Fatal(err)
+	}
+	imported := newTestService()
+	if err := imported.ImportFromFile(path); err != nil {
+		t.Fatal(err)
+	}
+	want := s.snapshotAccounts()
+	got := imported.snapshotAccounts()
+	if len(got) != len(want) {
+		t.Fatalf("imported %v accounts, want %v", len(got), len(want))
+	}
+	for i := range want {
+		if *got[i] != *want[i] {
+			t.Errorf("account %v = %v, want %v", i, got[i], want[i])
+		}
+	}
+}
+
+func TestService_ImportWithOptions_paymentStatus(t *testing.T) {
+	s := newTestService()
+	account, err := s.RegisterAccount("+992000000001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Deposit(account.ID, 100); err != nil {
+		t.Fatal(err)
+	}
+	payment, err := s.Pay(account.ID, 100, "auto")
+	if err != nil {
+		t.Fatal(err)
+	}
+	inProgress := t.TempDir()
+	if err := s.Export(inProgress); err != nil {
+		t.Fatal(err)
+	}
+	rejected := newTestService()
+	if err := rejected.Import(inProgress); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Reject(payment.ID); err != nil {
+		t.Fatal(err)
+	}
+	failed := t.TempDir()
+	if err := s.Export(failed); err != nil {
+		t.Fatal(err)
+	}
+
+	// Refunded payment can't go back in progress to be refunded again
+	options := ImportOptions{Payments: MergeOverwrite}
+	if _, err := s.ImportWithOptions(inProgress, options); !errors.Is(err, ErrImportConflict) {
+		t.Errorf("ImportWithOptions() of payment in progress error = %v, want %v", err, ErrImportConflict)
+	}
+	if err := s.Reject(payment.ID); !errors.Is(err, ErrInvalidTransition) {
+		t.Errorf("second Reject() error = %v, want %v", err, ErrInvalidTransition)
+	}
+	if got, err := s.FindAccountByID(account.ID); err != nil || got.Balance != 100 {
+		t.Errorf("account = %v, %v, want balance 100", got, err)
+	}
+
+	// Rejection is imported with its refund and transition
+	if _, err := rejected.ImportWithOptions(failed, options); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := rejected.FindAccountByID(account.ID); err != nil || got.Balance != 100 {
+		t.Errorf("imported account = %v, %v, want balance 100", got, err)
+	}
+	if err := rejected.VerifyLedger(); err != nil {
+		t.Error(err)
+	}
+	history, err := rejected.PaymentHistory(payment.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if last := history[len(history)-1]; last.Event != types.PaymentEventReject || last.To != types.PaymentStatusFail {
+		t.Errorf("last transition = %v, want rejection", last)
+	}
+	if err := rejected.Reject(payment.ID); !errors.Is(err, ErrInvalidTransition) {
+		t.Errorf("Reject() of imported rejection error = %v, want %v", err, ErrInvalidTransition)
+	}
+}
+
+func TestService_ImportWithOptions_skippedAccount(t *testing.T) {
+	s := newTestService()
+	if _, err := s.RegisterAccount("+992000000001"); err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	files := map[string]string{
+		"accounts.dump":  "2;+992000000001;10\n",
+		"payments.dump":  "p1;2;5;auto;OK\n",
+		"favorites.dump": "f1;2;home;5;auto\n",
+	}
+	for name, data := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(data), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	report, err := s.ImportWithOptions(dir, ImportOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []ImportIssue{
+		{File: "accounts.dump", Line: 1, Reason: "phone +992000000001 of account 2 belongs to account 1"},
+		{File: "payments.dump", Line: 1, Reason: "payment p1 of skipped account 2"},
+		{File: "favorites.dump", Line: 1, Reason: "favorite f1 of skipped account 2"},
+	}
+	if fmt.Sprint(report.Skipped) != fmt.Sprint(want) {
+		t.Errorf("skipped = %v, want %v", report.Skipped, want)
+	}
+	if payments := s.snapshotPayments(); len(payments) != 0 {
+		t.Errorf("payments = %v, want payment of skipped account skipped", payments)
+	}
+	if sum := s.SumPayments(1); sum != 0 {
+		t.Errorf("SumPayments() = %v, want 0", sum)
+	}
+	if favorites := s.storage().Favorites(); len(favorites) != 0 {
+		t.Errorf("favorites = %v, want favorite of skipped account skipped", favorites)
+	}
+}
+
+// countdownContext is canceled after Err is called calls times
+type countdownContext struct {
+	context.Context
+	calls int
+}
+
+func (c *countdownContext) Err() error {
+	c.calls--
+	if c.calls < 0 {
+		return context.Canceled
+	}
+	return nil
+}
+
+func TestService_HistoryToFiles_canceled(t *testing.T) {
+	s := newBenchmarkService(1, 3*checkEvery)
+	history, err := s.ExportAccountHistory(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	if err := s.HistoryToFiles(history[:10], dir, 0); err != nil {
+		t.Fatal(err)
+	}
+	for _, records := range []int{0, checkEvery} {
+		ctx := &countdownContext{Context: context.Background(), calls: 2}
+		if err := s.HistoryToFilesAsContext(ctx, history, dir, records, FormatDump); err != context.Canceled {
+			t.Errorf("records %v: HistoryToFilesAsContext() error = %v, want %v", records, err, context.Canceled)
+		}
+		infos, err := ioutil.ReadDir(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(infos) != 1 || infos[0].Name() != "payments.dump" {
+			t.Errorf("records %v: canceled export left %v files", records, len(infos))
+		}
+		imported := newTestService()
+		if err := imported.Import(dir); err != nil {
+			t.Fatal(err)
+		}
+		if got := len(imported.snapshotPayments()); got != 10 {
+			t.Errorf("records %v: imported %v payments, want 10", records, got)
+		}
+	}
+}
+
+func TestService_MonthlyStatement_legacy(t *testing.T) {
+	now := time.Date(2021, time.January, 10, 12, 0, 0, 0, time.UTC)
+	clock := func() time.Time {
+		return now
+	}
+	s := &testService{Service: NewService(NewMemoryRepository(), WithClock(clock))}
+	account, err := s.RegisterAccount("+992000000001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := s.RegisterAccount("+992000000002")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Deposit(account.ID, 100); err != nil {
+		t.Fatal(err)
+	}
+	now = now.AddDate(0, 0, 1)
+	payment, err := s.Pay(account.ID, 20, "auto")
+	if err != nil {
+		t.Fatal(err)
+	}
+	now = now.AddDate(0, 0, 1)
+	rejected, err := s.Pay(account.ID, 10, "food")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Reject(rejected.ID); err != nil {
+		t.Fatal(err)
+	}
+	now = now.AddDate(0, 0, 1)
+	debit, err := s.Transfer(account.ID, other.ID, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	received, err := s.MonthlyStatement(other.ID, 2021, time.January)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(received.Lines) != 1 || received.Lines[0].PaymentID != debit.LinkedID ||
+		received.Lines[0].Category != types.PaymentCategoryTransferIn {
+		t.Errorf("receiver lines = %+v, want transfer_in payment %v", received.Lines, debit.LinkedID)
+	}
+
+	// Dumps written before the ledger have no ledger.dump
+	dir := t.TempDir()
+	if err := s.Export(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(dir, currentLink, "ledger.dump")); err != nil {
+		t.Fatal(err)
+	}
+	imported := NewService(NewMemoryRepository(), WithClock(func() time.Time {
+		return time.Date(2021, time.March, 1, 0, 0, 0, 0, time.UTC)
+	}))
+	if err := imported.Import(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := imported.VerifyLedger(); err != nil {
+		t.Errorf("VerifyLedger() error = %v", err)
+	}
+	got, err := imported.MonthlyStatement(account.ID, 2021, time.January)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []struct {
+		kind      ledger.Kind
+		paymentID string
+		amount    types.Money
+		balance   types.Money
+	}{
+		{ledger.KindAdjustment, "", 100, 100},
+		{ledger.KindPayment, payment.ID, -20, 80},
+		{ledger.KindPayment, rejected.ID, -10, 70},
+		{ledger.KindRefund, rejected.ID, 10, 80},
+		{ledger.KindTransfer, debit.ID, -5, 75},
+	}
+	if got.Opening != 0 || got.Closing != 75 || len(got.Lines) != len(want) {
+		t.Fatalf("statement %v - %v with lines %+v, want 0 - 75 with %v lines", got.Opening, got.Closing, got.Lines, len(want))
+	}
+	for i, line := range got.Lines {
+		if line.Kind != want[i].kind || line.PaymentID != want[i].paymentID || line.Amount != want[i].amount || line.Balance != want[i].balance {
+			t.Errorf("line %v = %+v, want %+v", i, line, want[i])
+		}
+	}
+	received, err = imported.MonthlyStatement(other.ID, 2021, time.January)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(received.Lines) != 1 || received.Lines[0].PaymentID != debit.LinkedID || received.Closing != 5 {
+		t.Errorf("imported receiver lines = %+v, want transfer_in payment %v", received.Lines, debit.LinkedID)
+	}
+}
+
 // =========== Helper methods
 type testService struct {
 	*Service
@@ -334,3 +2455,26 @@ func (s *testService) addAccount(data testAccount) (*types.Account, []*types.Pay
 	}
 	return account, payments, nil
 }
+
+// newBenchmarkService creates service with accounts and payments spread
+// evenly between them, records are saved directly to skip the ledger
+func newBenchmarkService(accounts int, payments int) *testService {
+	s := newTestService()
+	changes := Changes{}
+	for i := 1; i <= accounts; i++ {
+		changes.Accounts = append(changes.Accounts, &types.Account{
+			ID:      int64(i),
+			Phone:   types.Phone(fmt.Sprintf("+992%09d", i)),
+			Balance: 1_000_00,
+		})
+	}
+	changes.Payments = benchmarkPayments(payments)
+	for i, payment := range changes.Payments {
+		payment.AccountID = int64(i%accounts + 1)
+	}
+	if err := s.storage().Save(changes); err != nil {
+		panic(err)
+	}
+	s.nextAccountID = int64(accounts)
+	return s
+}
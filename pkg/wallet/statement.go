@@ -0,0 +1,249 @@
+package wallet
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"html/template"
+	"io"
+	"sort"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/ilhom0258/wallet/pkg/ledger"
+	"github.com/ilhom0258/wallet/pkg/types"
+)
+
+// Statement lists changes of account balance over [From, To)
+type Statement struct {
+	AccountID int64
+	Phone     types.Phone
+	From      time.Time
+	To        time.Time
+	// Opening is balance at From
+	Opening types.Money
+	Lines   []StatementLine
+	// Closing is balance at To
+	Closing types.Money
+}
+
+// StatementLine is a single change of balance
+type StatementLine struct {
+	At   time.Time
+	Kind ledger.Kind
+	// PaymentID, Category and Status describe payment of the line, they are
+	// empty for deposits and adjustments
+	PaymentID   string
+	Category    types.PaymentCategory
+	Status      types.PaymentStatus
+	Description string
+	// Amount is positive when money comes in and negative when it goes out
+	Amount types.Money
+	// Balance is balance after the line
+	Balance types.Money
+}
+
+// MonthlyStatement returns statement of the account for the calendar month
+// in UTC
+func (s *Service) MonthlyStatement(accountID int64, year int, month time.Month) (*Statement, error) {
+	from := time.Date(year, month, 1, 0, 0, 0, 0, time.UTC)
+	return s.Statement(accountID, from, from.AddDate(0, 1, 0))
+}
+
+// Statement returns statement of the account for [from, to). Lines are made
+// from the ledger, so deposits, refunds and transfers are listed along with
+// payments of ExportAccountHistory. Zero from or to leaves the period open
+// from that side.
+func (s *Service) Statement(accountID int64, from time.Time, to time.Time) (*Statement, error) {
+	return s.StatementContext(context.Background(), accountID, from, to)
+}
+
+// StatementContext builds statement like Statement and stops when ctx is done
+func (s *Service) StatementContext(ctx context.Context, accountID int64, from time.Time, to time.Time) (*Statement, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	account := s.findAccount(accountID)
+	if account == nil {
+		return nil, ErrAccountNotFound
+	}
+	// Transfer entries are keyed by the debit payment, the receiving side
+	// finds its credit payment by the link
+	payments := map[string]*types.Payment{}
+	linked := map[string]*types.Payment{}
+	for _, payment := range s.storage().PaymentsByAccount(accountID) {
+		payments[payment.ID] = payment
+		if payment.LinkedID != "" {
+			linked[payment.LinkedID] = payment
+		}
+	}
+
+	// Imported history is posted after entries made before the import, so
+	// entries are put in order of their times
+	name := ledger.Wallet(accountID)
+	var entries []*ledger.Entry
+	for i, entry := range s.storage().Entries() {
+		if err := interrupted(ctx, i); err != nil {
+			return nil, err
+		}
+		if entry.Amount(name) != 0 {
+			entries = append(entries, entry)
+		}
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].At.Before(entries[j].At)
+	})
+
+	statement := &Statement{AccountID: accountID, Phone: account.Phone, From: from, To: to, Lines: []StatementLine{}}
+	balance := types.Money(0)
+	for _, entry := range entries {
+		amount := entry.Amount(name)
+		if !to.IsZero() && !entry.At.Before(to) {
+			break
+		}
+		balance += amount
+		if !from.IsZero() && entry.At.Before(from) {
+			statement.Opening = balance
+			continue
+		}
+		line := StatementLine{At: entry.At, Kind: entry.Kind, Amount: amount, Balance: balance}
+		payment := payments[entry.PaymentID]
+		if payment == nil {
+			payment = linked[entry.PaymentID]
+		}
+		if payment != nil {
+			line.PaymentID = payment.ID
+			line.Category = payment.Category
+			line.Status = payment.Status
+		}
+		line.Description = describe(entry, line, name)
+		statement.Lines = append(statement.Lines, line)
+	}
+	statement.Closing = balance
+	return statement, nil
+}
+
+// describe returns human readable description of entry of the line
+func describe(entry *ledger.Entry, line StatementLine, wallet string) string {
+	switch entry.Kind {
+	case ledger.KindDeposit:
+		return "deposit"
+	case ledger.KindPayment:
+		return "payment: " + string(line.Category)
+	case ledger.KindRefund:
+		return "refund: " + string(line.Category)
+	case ledger.KindAdjustment:
+		return "balance adjustment"
+	case ledger.KindTransfer:
+		for _, leg := range entry.Legs {
+			if id, ok := ledger.WalletID(leg.Account); ok && leg.Account != wallet {
+				if line.Amount < 0 {
+					return fmt.Sprintf("transfer to account %v", id)
+				}
+				return fmt.Sprintf("transfer from account %v", id)
+			}
+		}
+		return "transfer"
+	default:
+		return string(entry.Kind)
+	}
+}
+
+// WriteText writes statement as plain text table
+func (st *Statement) WriteText(w io.Writer) error {
+	if _, err := fmt.Fprintf(w, "Statement of account %v (%v)\nPeriod %v\n\n", st.AccountID, st.Phone, st.period()); err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "Date\tDescription\tAmount\tBalance\n")
+	fmt.Fprintf(tw, "\tOpening balance\t\t%v\n", formatMoney(st.Opening))
+	for _, line := range st.Lines {
+		fmt.Fprintf(tw, "%v\t%v\t%v\t%v\n", line.At.Format(statementTime), line.Description, formatMoney(line.Amount), formatMoney(line.Balance))
+	}
+	fmt.Fprintf(tw, "\tClosing balance\t\t%v\n", formatMoney(st.Closing))
+	return tw.Flush()
+}
+
+// WriteCSV writes statement as CSV file with opening and closing balances
+// as the first and the last rows
+func (st *Statement) WriteCSV(w io.Writer) error {
+	writer := csv.NewWriter(w)
+	writer.Write([]string{"date", "kind", "payment_id", "category", "status", "description", "amount", "balance"})
+	writer.Write([]string{formatTime(st.From), "OPENING", "", "", "", "opening balance", "", strconv.FormatInt(int64(st.Opening), 10)})
+	for _, line := range st.Lines {
+		writer.Write([]string{
+			formatTime(line.At),
+			string(line.Kind),
+			line.PaymentID,
+			string(line.Category),
+			string(line.Status),
+			line.Description,
+			strconv.FormatInt(int64(line.Amount), 10),
+			strconv.FormatInt(int64(line.Balance), 10),
+		})
+	}
+	writer.Write([]string{formatTime(st.To), "CLOSING", "", "", "", "closing balance", "", strconv.FormatInt(int64(st.Closing), 10)})
+	writer.Flush()
+	return writer.Error()
+}
+
+// WriteHTML writes statement as HTML page
+func (st *Statement) WriteHTML(w io.Writer) error {
+	return statementTemplate.Execute(w, st)
+}
+
+// statementTime is layout of times in text and HTML statements
+const statementTime = "2006-01-02 15:04"
+
+func (st *Statement) period() string {
+	from, to := "beginning", "now"
+	if !st.From.IsZero() {
+		from = st.From.Format(statementTime)
+	}
+	if !st.To.IsZero() {
+		to = st.To.Format(statementTime)
+	}
+	return from + " - " + to
+}
+
+// formatMoney formats amount in minimal units as major units with two decimals
+func formatMoney(amount types.Money) string {
+	sign := ""
+	if amount < 0 {
+		sign = "-"
+		amount = -amount
+	}
+	return fmt.Sprintf("%s%d.%02d", sign, amount/100, amount%100)
+}
+
+var statementTemplate = template.Must(template.New("statement").Funcs(template.FuncMap{
+	"money":  formatMoney,
+	"period": (*Statement).period,
+	"time": func(t time.Time) string {
+		return t.Format(statementTime)
+	},
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Statement of account {{.AccountID}}</title>
+</head>
+<body>
+<h1>Statement of account {{.AccountID}} ({{.Phone}})</h1>
+<p>Period {{period .}}</p>
+<table>
+<thead>
+<tr><th>Date</th><th>Description</th><th>Amount</th><th>Balance</th></tr>
+</thead>
+<tbody>
+<tr><td></td><td>Opening balance</td><td></td><td>{{money .Opening}}</td></tr>
+{{- range .Lines}}
+<tr><td>{{time .At}}</td><td>{{.Description}}</td><td>{{money .Amount}}</td><td>{{money .Balance}}</td></tr>
+{{- end}}
+<tr><td></td><td>Closing balance</td><td></td><td>{{money .Closing}}</td></tr>
+</tbody>
+</table>
+</body>
+</html>
+`))